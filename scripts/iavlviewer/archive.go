@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	formatZip    = "zip"
+	formatTar    = "tar"
+	formatTarGz  = "tar.gz"
+	formatTarLz4 = "tar.lz4"
+	formatTarZst = "tar.zst"
+)
+
+// sniffLen is how much of an archive sniffArchive needs: the tar magic sits
+// at offset 257 of the first header block.
+const sniffLen = 512
+
+// sniffArchive identifies an archive from its first bytes, falling back to the
+// file name for old tar files without the ustar magic.
+func sniffArchive(head []byte, name string) (string, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatTarGz, nil
+	case bytes.HasPrefix(head, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return formatTarLz4, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatTarZst, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar, nil
+	case strings.HasSuffix(strings.ToLower(name), ".tar"):
+		return formatTar, nil
+	}
+	return "", fmt.Errorf("unrecognized archive format (supported: zip, tar, tar.gz, tar.lz4, tar.zst)")
+}
+
+// isArchiveName reports whether a path looks like a supported archive.
+func isArchiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.lz4", ".tar.zst", ".tar.zstd"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractArchiveFile extracts a zip or (compressed) tar file into destDir.
+// name is used to recognize old tar files that lack the ustar magic.
+func extractArchiveFile(ctx context.Context, path, name, destDir string, progress progressFunc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	format, err := sniffArchive(head, name)
+	if err != nil {
+		return err
+	}
+	if format == formatZip {
+		return extractZipFromFile(ctx, path, destDir, progress)
+	}
+	return extractTarStream(ctx, br, format, destDir, progress)
+}
+
+// extractArchiveBytes extracts an uploaded zip or (compressed) tar.
+func extractArchiveBytes(ctx context.Context, data []byte, name, destDir string, progress progressFunc) error {
+	format, err := sniffArchive(data[:min(len(data), sniffLen)], name)
+	if err != nil {
+		return err
+	}
+	if format == formatZip {
+		return extractZipFromBytes(ctx, data, destDir, progress)
+	}
+	return extractTarStream(ctx, bytes.NewReader(data), format, destDir, progress)
+}
+
+// downloadAndExtractArchive downloads url to its partial file (see
+// partialDownloadPath), verifies it against expectedSHA256 when set, and
+// extracts it. The partial file is only removed after a successful extract,
+// so a download that runs out of retries, is cancelled or is cut short by a
+// restart resumes where it stopped the next time.
+func downloadAndExtractArchive(ctx context.Context, url, expectedSHA256, destDir string, progress progressFunc) error {
+	path := partialDownloadPath(url, destDir)
+	unlock, err := lockDownload(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := downloadFile(ctx, url, path, expectedSHA256, progress); err != nil {
+		return err
+	}
+	if err := extractArchiveFile(ctx, path, url, destDir, progress); err != nil {
+		return err
+	}
+	removePartialDownload(path)
+	return nil
+}
+
+// extractTarStream decompresses r according to format and writes the tar
+// entries below destDir as they are read, so memory use stays constant.
+func extractTarStream(ctx context.Context, r io.Reader, format, destDir string, progress progressFunc) error {
+	budget := newExtractBudget(destDir)
+	if format != formatTar {
+		counter := &countingReader{r: r}
+		budget.compressed = func() int64 { return counter.n }
+		r = counter
+	}
+	switch format {
+	case formatTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("invalid gzip stream: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	case formatTarLz4:
+		r = lz4.NewReader(r)
+	case formatTarZst:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("invalid zstd stream: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	files := 0
+	var lastReport time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s archive: %v", format, err)
+		}
+
+		path := filepath.Join(destDir, hdr.Name)
+		if path != filepath.Clean(destDir) && !strings.HasPrefix(path, filepath.Clean(destDir)+string(os.PathSeparator)) {
+			return limitf("entry %s escapes the destination directory", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := budget.addEntry(hdr.Name, 0); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := budget.addEntry(hdr.Name, hdr.Size); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			// Archive modes are ignored: DB files only need to be readable
+			// and writable by us.
+			out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(budget.writer(out), tr)
+			out.Close()
+			var limitErr *archiveLimitError
+			if errors.As(err, &limitErr) {
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+			}
+			files++
+		case tar.TypeXGlobalHeader:
+			// PAX metadata for the whole archive, as written by git archive.
+		case tar.TypeSymlink, tar.TypeLink:
+			return limitf("link entry %s -> %s is not allowed", hdr.Name, hdr.Linkname)
+		default:
+			return limitf("special file entry %s (type %q) is not allowed", hdr.Name, hdr.Typeflag)
+		}
+
+		if time.Since(lastReport) >= progressInterval {
+			lastReport = time.Now()
+			progress.report(ProgressEvent{Event: EventExtract, FilesExtracted: files})
+		}
+	}
+	progress.report(ProgressEvent{Event: EventExtract, FilesExtracted: files, FilesTotal: files})
+	return nil
+}
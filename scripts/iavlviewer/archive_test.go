@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	data []byte
+}
+
+func buildTar(t *testing.T, entries []tarEntry, gzipped bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var gz *gzip.Writer
+	var tw *tar.Writer
+	if gzipped {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+type zipEntry struct {
+	name string
+	mode os.FileMode
+	data []byte
+}
+
+func buildZip(t *testing.T, entries []zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		hdr.SetMode(mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withArchiveLimits runs the test with limits in place of the defaults.
+func withArchiveLimits(t *testing.T, limits extractLimits) {
+	t.Helper()
+	saved := archiveLimits
+	archiveLimits = limits
+	t.Cleanup(func() { archiveLimits = saved })
+}
+
+func TestArchiveLimits(t *testing.T) {
+	defaults := extractLimits{maxBytes: 1 << 30, maxEntries: 100, maxRatio: 200}
+	reg := func(name string, data []byte) tarEntry {
+		return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, data: data}
+	}
+	zeros := make([]byte, 4<<20)
+
+	tests := []struct {
+		name    string
+		limits  extractLimits
+		archive func(t *testing.T) ([]byte, string)
+	}{
+		{
+			name: "tar path traversal",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{reg("../escape", []byte("x"))}, false), "a.tar"
+			},
+		},
+		{
+			name: "tar symlink",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}}, false), "a.tar"
+			},
+		},
+		{
+			name: "tar hardlink",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{
+					reg("file", []byte("x")),
+					{hdr: tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "file"}},
+				}, false), "a.tar"
+			},
+		},
+		{
+			name: "tar device",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{{hdr: tar.Header{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}}, false), "a.tar"
+			},
+		},
+		{
+			name:   "tar entry cap",
+			limits: extractLimits{maxEntries: 2},
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{reg("a", nil), reg("b", nil), reg("c", nil)}, false), "a.tar"
+			},
+		},
+		{
+			name:   "tar byte cap",
+			limits: extractLimits{maxBytes: 10},
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{reg("a", make([]byte, 20))}, false), "a.tar"
+			},
+		},
+		{
+			name: "tar.gz compression ratio",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildTar(t, []tarEntry{reg("bomb", zeros)}, true), "a.tar.gz"
+			},
+		},
+		{
+			name: "zip path traversal",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildZip(t, []zipEntry{{name: "../escape", data: []byte("x")}}), "a.zip"
+			},
+		},
+		{
+			name: "zip symlink",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildZip(t, []zipEntry{{name: "link", mode: os.ModeSymlink | 0777, data: []byte("/etc/passwd")}}), "a.zip"
+			},
+		},
+		{
+			name: "zip device",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildZip(t, []zipEntry{{name: "null", mode: os.ModeDevice | os.ModeCharDevice | 0644}}), "a.zip"
+			},
+		},
+		{
+			name:   "zip entry cap",
+			limits: extractLimits{maxEntries: 2},
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildZip(t, []zipEntry{{name: "a"}, {name: "b"}, {name: "c"}}), "a.zip"
+			},
+		},
+		{
+			name:   "zip byte cap",
+			limits: extractLimits{maxBytes: 10},
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildZip(t, []zipEntry{{name: "a", data: make([]byte, 20)}}), "a.zip"
+			},
+		},
+		{
+			name: "zip compression ratio",
+			archive: func(t *testing.T) ([]byte, string) {
+				return buildZip(t, []zipEntry{{name: "bomb", data: zeros}}), "a.zip"
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := tt.limits
+			if limits == (extractLimits{}) {
+				limits = defaults
+			}
+			withArchiveLimits(t, limits)
+			data, name := tt.archive(t)
+			dest := t.TempDir()
+			err := extractArchiveBytes(context.Background(), data, name, dest, nil)
+			var limitErr *archiveLimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("err = %v, want an archiveLimitError", err)
+			}
+			if errorType(err) != ErrorTypeArchiveLimit {
+				t.Errorf("errorType = %q, want %q", errorType(err), ErrorTypeArchiveLimit)
+			}
+		})
+	}
+}
+
+func TestArchiveWithinLimits(t *testing.T) {
+	withArchiveLimits(t, extractLimits{maxBytes: 1 << 20, maxEntries: 10, maxRatio: 200})
+	tarData := buildTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "app/application.db/CURRENT", Typeflag: tar.TypeReg}, data: []byte("MANIFEST-000001\n")},
+	}, true)
+	zipData := buildZip(t, []zipEntry{{name: "app/application.db/CURRENT", data: []byte("MANIFEST-000001\n")}})
+	for name, data := range map[string][]byte{"a.tar.gz": tarData, "a.zip": zipData} {
+		dest := t.TempDir()
+		if err := extractArchiveBytes(context.Background(), data, name, dest, nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(dest + "/app/application.db/CURRENT"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
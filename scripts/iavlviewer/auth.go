@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hmacMaxSkew is how far the timestamp of a signed request may be from
+	// the server clock; it also bounds how long a captured request can be
+	// replayed.
+	hmacMaxSkew = 5 * time.Minute
+	// hmacMaxBody caps the body of a signed request, which is buffered to
+	// check its hash. Larger archives go through resumable uploads in chunks.
+	hmacMaxBody = 8 << 20
+	// eventsTokenTTL is how long the token in a job's events_url opens its
+	// progress stream; GET /jobs/{id} hands out a fresh one.
+	eventsTokenTTL = 10 * time.Minute
+)
+
+// authConfig is the file given with --auth-config. Every endpoint except
+// /health then needs a token, e.g.
+//
+//	{"tokens": [
+//	  {"name": "ci", "token_sha256": "<sha256 of the token>", "source_types": ["archive_url", "upload"], "max_concurrent_jobs": 2},
+//	  {"name": "bot", "hmac_secret": "<secret>", "require_hmac": true}
+//	]}
+//
+// See authenticate for how requests carry them, and requestOwner for what
+// each token may see.
+type authConfig struct {
+	Tokens []*authToken `json:"tokens"`
+}
+
+// authToken is a client of the API and what it may do.
+type authToken struct {
+	Name string `json:"name"`
+	// Token is the bearer token. TokenSHA256 may be given instead, so the
+	// config file doesn't hold the secret itself.
+	Token       string `json:"token,omitempty"`
+	TokenSHA256 string `json:"token_sha256,omitempty"`
+	// HMACSecret lets the client sign requests instead; with RequireHMAC
+	// set, bearer authentication is refused for this token.
+	HMACSecret  string `json:"hmac_secret,omitempty"`
+	RequireHMAC bool   `json:"require_hmac,omitempty"`
+	// SourceTypes limits the source types the token may compare; empty
+	// allows all of them.
+	SourceTypes []string `json:"source_types,omitempty"`
+	// MaxConcurrentJobs caps the comparisons the token runs at once; zero
+	// means no cap.
+	MaxConcurrentJobs int `json:"max_concurrent_jobs,omitempty"`
+}
+
+var (
+	// authTokens is nil when authentication is disabled.
+	authTokens []*authToken
+	// corsOrigins are the origins browsers may call the API from; "*"
+	// allows any. It defaults to none when authentication is enabled.
+	corsOrigins = []string{"*"}
+
+	// eventsTokenKey signs the tokens in events_url. It is drawn at start,
+	// so a restart invalidates the tokens handed out before.
+	eventsTokenKey = func() []byte {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(fmt.Sprintf("failed to generate the events token key: %v", err))
+		}
+		return key
+	}()
+
+	runningJobsMu sync.Mutex
+	runningJobs   = map[string]int{}
+)
+
+type authTokenKey struct{}
+
+// apiError is the body of failures that happen before a handler runs.
+type apiError struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+func loadAuthConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read auth config: %v", err)
+	}
+	var cfg authConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("invalid auth config %s: %v", path, err)
+	}
+	if len(cfg.Tokens) == 0 {
+		return fmt.Errorf("auth config %s defines no tokens", path)
+	}
+	names := map[string]bool{}
+	for _, t := range cfg.Tokens {
+		switch {
+		case t.Name == "" || names[t.Name]:
+			return fmt.Errorf("auth config %s: every token needs a unique name", path)
+		case t.Token == "" && t.TokenSHA256 == "" && t.HMACSecret == "":
+			return fmt.Errorf("auth config %s: token %s has no token, token_sha256 or hmac_secret", path, t.Name)
+		case t.RequireHMAC && t.HMACSecret == "":
+			return fmt.Errorf("auth config %s: token %s requires HMAC but has no hmac_secret", path, t.Name)
+		}
+		names[t.Name] = true
+		t.TokenSHA256 = strings.ToLower(t.TokenSHA256)
+		for i, st := range t.SourceTypes {
+			t.SourceTypes[i] = canonicalSourceType(st)
+		}
+	}
+	authTokens = cfg.Tokens
+	return nil
+}
+
+// canonicalSourceType maps the legacy zip_* aliases to the archive types.
+func canonicalSourceType(t string) string {
+	switch t {
+	case "zip_file":
+		return "archive_file"
+	case "zip_url":
+		return "archive_url"
+	}
+	return t
+}
+
+// authenticate identifies the client of r, either from an
+// "Authorization: Bearer <token>" header or from a signed request:
+//
+//	Authorization: HMAC <token name>:<hex signature>
+//	X-Timestamp:   <unix seconds>
+//
+// where the signature is the HMAC-SHA256, keyed with the token's
+// hmac_secret, of method, request URI, timestamp and the hex sha256 of the
+// body, joined by newlines.
+func authenticate(r *http.Request) (*authToken, error) {
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && credentials != "":
+		sum := sha256.Sum256([]byte(credentials))
+		hashed := hex.EncodeToString(sum[:])
+		for _, t := range authTokens {
+			if (t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(credentials)) == 1) ||
+				(t.TokenSHA256 != "" && subtle.ConstantTimeCompare([]byte(t.TokenSHA256), []byte(hashed)) == 1) {
+				if t.RequireHMAC {
+					return nil, fmt.Errorf("token %s must sign its requests", t.Name)
+				}
+				return t, nil
+			}
+		}
+		return nil, errors.New("invalid bearer token")
+
+	case strings.EqualFold(scheme, "HMAC") && credentials != "":
+		name, signature, _ := strings.Cut(credentials, ":")
+		var token *authToken
+		for _, t := range authTokens {
+			if t.Name == name && t.HMACSecret != "" {
+				token = t
+			}
+		}
+		if token == nil {
+			return nil, errors.New("invalid request signature")
+		}
+		timestamp := r.Header.Get("X-Timestamp")
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, errors.New("missing or invalid X-Timestamp header")
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+			return nil, errors.New("request timestamp is too far from the server time")
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, hmacMaxBody))
+		if err != nil {
+			return nil, fmt.Errorf("signed request bodies are limited to %d bytes; upload larger archives in chunks", hmacMaxBody)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodySum := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, []byte(token.HMACSecret))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+			return nil, errors.New("invalid request signature")
+		}
+		return token, nil
+	}
+	return nil, errors.New("missing Authorization header")
+}
+
+// requireAuth rejects unauthenticated requests when authentication is
+// enabled and passes the token on in the request context. CORS preflight
+// requests carry no credentials and always go through.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authTokens == nil || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		token, err := authenticate(r)
+		if err != nil {
+			rejectUnauthenticated(w, r, err)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), authTokenKey{}, token)))
+	}
+}
+
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, err error) {
+	fmt.Printf("[Auth] %s %s from %s rejected: %v\n", r.Method, r.URL.Path, r.RemoteAddr, err)
+	setCORSHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="iavlviewer"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(apiError{Success: false, Error: err.Error()})
+}
+
+// requireAuthOrEventsToken is requireAuth for /jobs/{id}/events. A browser
+// EventSource cannot send an Authorization header, so the route also takes
+// the events token from the job's events_url in the "token" query parameter.
+// The token only opens the stream of that job.
+func requireAuthOrEventsToken(next http.HandlerFunc) http.HandlerFunc {
+	auth := requireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get("token")
+		if authTokens == nil || value == "" || r.Header.Get("Authorization") != "" {
+			auth(w, r)
+			return
+		}
+		id := r.PathValue("id")
+		jobsMu.Lock()
+		j := jobs[id]
+		jobsMu.Unlock()
+		if j == nil || !checkEventsToken(value, id, j.owner, time.Now()) {
+			rejectUnauthenticated(w, r, errors.New("invalid or expired events token"))
+			return
+		}
+		for _, t := range authTokens {
+			if t.Name == j.owner {
+				next(w, r.WithContext(context.WithValue(r.Context(), authTokenKey{}, t)))
+				return
+			}
+		}
+		rejectUnauthenticated(w, r, errors.New("invalid or expired events token"))
+	}
+}
+
+// newEventsToken returns a token, valid for eventsTokenTTL from now, for
+// the events stream of the job id started by owner. It has the form
+// <expiry unix seconds>.<hex HMAC-SHA256 under eventsTokenKey>.
+func newEventsToken(id, owner string, now time.Time) string {
+	expires := strconv.FormatInt(now.Add(eventsTokenTTL).Unix(), 10)
+	return expires + "." + eventsTokenMAC(id, owner, expires)
+}
+
+func checkEventsToken(value, id, owner string, now time.Time) bool {
+	expires, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.After(time.Unix(unix, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(eventsTokenMAC(id, owner, expires)))
+}
+
+func eventsTokenMAC(id, owner, expires string) string {
+	mac := hmac.New(sha256.New, eventsTokenKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s", id, owner, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestToken returns the token that authenticated r, or nil when
+// authentication is disabled.
+func requestToken(r *http.Request) *authToken {
+	token, _ := r.Context().Value(authTokenKey{}).(*authToken)
+	return token
+}
+
+// requestOwner names the client that owns what r creates: the jobs,
+// uploads and comparisons only it may see. Other clients get 404 for them,
+// cannot use its uploads as sources and don't see its comparisons in
+// GET /comparisons. It is empty when authentication is disabled, which
+// shares everything.
+func requestOwner(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		return token.Name
+	}
+	return ""
+}
+
+// checkSources reports a source type the token may not use.
+func (t *authToken) checkSources(req CompareRequest) error {
+	if t == nil || len(t.SourceTypes) == 0 {
+		return nil
+	}
+	for i, source := range []DataSourceRequest{req.Source1, req.Source2} {
+		if !slices.Contains(t.SourceTypes, canonicalSourceType(source.Type)) {
+			return fmt.Errorf("source%d rejected: token %s may not use %q sources", i+1, t.Name, source.Type)
+		}
+	}
+	return nil
+}
+
+// acquireJobSlot counts a comparison against the token's concurrency cap.
+// The returned function gives the slot back.
+func (t *authToken) acquireJobSlot() (release func(), err error) {
+	if t == nil {
+		return func() {}, nil
+	}
+	runningJobsMu.Lock()
+	defer runningJobsMu.Unlock()
+	if t.MaxConcurrentJobs > 0 && runningJobs[t.Name] >= t.MaxConcurrentJobs {
+		return nil, fmt.Errorf("token %s has reached its limit of %d concurrent comparisons", t.Name, t.MaxConcurrentJobs)
+	}
+	runningJobs[t.Name]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			runningJobsMu.Lock()
+			runningJobs[t.Name]--
+			runningJobsMu.Unlock()
+		})
+	}, nil
+}
+
+// setCORSHeaders allows the configured origins to call the API from a
+// browser.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	switch {
+	case slices.Contains(corsOrigins, "*"):
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && slices.Contains(corsOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Range, Authorization, X-Timestamp")
+}
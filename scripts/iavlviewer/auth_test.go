@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withAuthTokens(t *testing.T, tokens ...*authToken) {
+	t.Helper()
+	saved := authTokens
+	authTokens = tokens
+	t.Cleanup(func() { authTokens = saved })
+}
+
+// signRequest signs r as an HMAC client would, over signedBody rather than
+// the body r carries so tests can tamper with either.
+func signRequest(r *http.Request, name, secret string, ts time.Time, signedBody string) {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	bodySum := sha256.Sum256([]byte(signedBody))
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", r.Method, r.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+	r.Header.Set("Authorization", "HMAC "+name+":"+hex.EncodeToString(mac.Sum(nil)))
+	r.Header.Set("X-Timestamp", timestamp)
+}
+
+func TestAuthenticate(t *testing.T) {
+	hashed := sha256.Sum256([]byte("hashed-secret"))
+	withAuthTokens(t,
+		&authToken{Name: "plain", Token: "plain-secret"},
+		&authToken{Name: "hashed", TokenSHA256: hex.EncodeToString(hashed[:])},
+		&authToken{Name: "signer", Token: "signer-secret", HMACSecret: "key", RequireHMAC: true},
+	)
+	const body = `{"source1":{}}`
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		want    string // token name, or "" for a rejection
+	}{
+		{
+			name:    "bearer token",
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", "Bearer plain-secret") },
+			want:    "plain",
+		},
+		{
+			name:    "bearer token matched by sha256",
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", "bearer hashed-secret") },
+			want:    "hashed",
+		},
+		{
+			name:    "unknown bearer token",
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") },
+		},
+		{
+			name:    "bearer refused when hmac is required",
+			prepare: func(r *http.Request) { r.Header.Set("Authorization", "Bearer signer-secret") },
+		},
+		{
+			name:    "missing header",
+			prepare: func(r *http.Request) {},
+		},
+		{
+			name:    "signed request",
+			prepare: func(r *http.Request) { signRequest(r, "signer", "key", now, body) },
+			want:    "signer",
+		},
+		{
+			name:    "signed request within skew",
+			prepare: func(r *http.Request) { signRequest(r, "signer", "key", now.Add(-hmacMaxSkew+time.Minute), body) },
+			want:    "signer",
+		},
+		{
+			name:    "signed request too old",
+			prepare: func(r *http.Request) { signRequest(r, "signer", "key", now.Add(-hmacMaxSkew-time.Minute), body) },
+		},
+		{
+			name:    "signed request from the future",
+			prepare: func(r *http.Request) { signRequest(r, "signer", "key", now.Add(hmacMaxSkew+time.Minute), body) },
+		},
+		{
+			name:    "body changed after signing",
+			prepare: func(r *http.Request) { signRequest(r, "signer", "key", now, `{"source1":{"type":"local"}}`) },
+		},
+		{
+			name:    "wrong secret",
+			prepare: func(r *http.Request) { signRequest(r, "signer", "other", now, body) },
+		},
+		{
+			name:    "token without hmac secret",
+			prepare: func(r *http.Request) { signRequest(r, "plain", "", now, body) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/compare?x=1", strings.NewReader(body))
+			tt.prepare(r)
+			token, err := authenticate(r)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("authenticated as %s, want a rejection", token.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if token.Name != tt.want {
+				t.Errorf("token = %s, want %s", token.Name, tt.want)
+			}
+			// The handler still gets the whole body after it was hashed.
+			if got, _ := io.ReadAll(r.Body); string(got) != body {
+				t.Errorf("body = %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	var seen *authToken
+	var called bool
+	handler := requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		seen = requestToken(r)
+	})
+	serve := func(method, authorization string) int {
+		called, seen = false, nil
+		r := httptest.NewRequest(method, "/jobs/x", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		withAuthTokens(t)
+		if code := serve(http.MethodGet, ""); code != http.StatusOK || !called || seen != nil {
+			t.Errorf("code = %d, called = %v, token = %v", code, called, seen)
+		}
+	})
+
+	withAuthTokens(t, &authToken{Name: "ci", Token: "secret"})
+	if code := serve(http.MethodGet, ""); code != http.StatusUnauthorized || called {
+		t.Errorf("without credentials: code = %d, called = %v", code, called)
+	}
+	if code := serve(http.MethodGet, "Bearer wrong"); code != http.StatusUnauthorized || called {
+		t.Errorf("wrong token: code = %d, called = %v", code, called)
+	}
+	if code := serve(http.MethodGet, "Bearer secret"); code != http.StatusOK || seen == nil || seen.Name != "ci" {
+		t.Errorf("valid token: code = %d, token = %v", code, seen)
+	}
+	if code := serve(http.MethodOptions, ""); code != http.StatusOK || !called {
+		t.Errorf("preflight: code = %d, called = %v", code, called)
+	}
+}
+
+func TestTokenSourceTypes(t *testing.T) {
+	token := &authToken{Name: "ci", SourceTypes: []string{"archive_url", "upload"}}
+	request := func(type1, type2 string) CompareRequest {
+		return CompareRequest{Source1: DataSourceRequest{Type: type1}, Source2: DataSourceRequest{Type: type2}}
+	}
+	if err := token.checkSources(request("archive_url", "upload")); err != nil {
+		t.Errorf("allowed types rejected: %v", err)
+	}
+	if err := token.checkSources(request("zip_url", "upload")); err != nil {
+		t.Errorf("zip_url alias rejected: %v", err)
+	}
+	if err := token.checkSources(request("upload", "local")); err == nil {
+		t.Error("local source accepted")
+	}
+	if err := (&authToken{Name: "any"}).checkSources(request("local", "local")); err != nil {
+		t.Errorf("token without source_types rejected: %v", err)
+	}
+	var none *authToken
+	if err := none.checkSources(request("local", "local")); err != nil {
+		t.Errorf("disabled authentication rejected: %v", err)
+	}
+}
+
+func TestTokenMaxConcurrentJobs(t *testing.T) {
+	token := &authToken{Name: "test-concurrency", MaxConcurrentJobs: 2}
+	release1, err := token.acquireJobSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := token.acquireJobSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := token.acquireJobSlot(); err == nil {
+		t.Fatal("third concurrent job admitted")
+	}
+	// Releasing twice must not free a second slot.
+	release1()
+	release1()
+	release3, err := token.acquireJobSlot()
+	if err != nil {
+		t.Fatalf("slot not given back: %v", err)
+	}
+	if _, err := token.acquireJobSlot(); err == nil {
+		t.Fatal("double release freed an extra slot")
+	}
+	release2()
+	release3()
+}
+
+func TestJobOwnership(t *testing.T) {
+	withAuthTokens(t, &authToken{Name: "a", Token: "ta"}, &authToken{Name: "b", Token: "tb"})
+	jobsMu.Lock()
+	jobs["owned-job"] = &job{status: JobStatus{ID: "owned-job", State: JobQueued}, owner: "a", cancel: func() {}, changed: make(chan struct{})}
+	jobsMu.Unlock()
+	t.Cleanup(func() {
+		jobsMu.Lock()
+		delete(jobs, "owned-job")
+		jobsMu.Unlock()
+	})
+
+	handler := requireAuth(handleJobStatusAPI)
+	for _, tt := range []struct {
+		method, token string
+		want          int
+	}{
+		{http.MethodGet, "tb", http.StatusNotFound},
+		{http.MethodDelete, "tb", http.StatusNotFound},
+		{http.MethodGet, "ta", http.StatusOK},
+		{http.MethodDelete, "ta", http.StatusAccepted},
+	} {
+		r := httptest.NewRequest(tt.method, "/jobs/owned-job", nil)
+		r.SetPathValue("id", "owned-job")
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s as %s: code = %d, want %d", tt.method, tt.token, w.Code, tt.want)
+		}
+	}
+}
+
+func TestEventsToken(t *testing.T) {
+	withAuthTokens(t, &authToken{Name: "a", Token: "ta"}, &authToken{Name: "b", Token: "tb"})
+	jobsMu.Lock()
+	jobs["streamed-job"] = &job{status: JobStatus{ID: "streamed-job", State: JobQueued, EventsURL: "/jobs/streamed-job/events"}, owner: "a", cancel: func() {}, changed: make(chan struct{})}
+	jobs["other-job"] = &job{status: JobStatus{ID: "other-job", State: JobQueued}, owner: "a", cancel: func() {}, changed: make(chan struct{})}
+	j := jobs["streamed-job"]
+	jobsMu.Unlock()
+	t.Cleanup(func() {
+		jobsMu.Lock()
+		delete(jobs, "streamed-job")
+		delete(jobs, "other-job")
+		jobsMu.Unlock()
+	})
+
+	eventsURL := j.ownerStatus().EventsURL
+	_, token, ok := strings.Cut(eventsURL, "?token=")
+	if !ok {
+		t.Fatalf("events_url %q carries no token", eventsURL)
+	}
+	expired := newEventsToken("streamed-job", "a", time.Now().Add(-2*eventsTokenTTL))
+
+	// The stand-in for the stream handler checks the job is visible to the
+	// client the token stands for.
+	handler := requireAuthOrEventsToken(handleJobStatusAPI)
+	for _, tt := range []struct {
+		name, id, query, bearer string
+		want                    int
+	}{
+		{"token", "streamed-job", "?token=" + token, "", http.StatusOK},
+		{"no credentials", "streamed-job", "", "", http.StatusUnauthorized},
+		{"expired token", "streamed-job", "?token=" + expired, "", http.StatusUnauthorized},
+		{"tampered token", "streamed-job", "?token=" + token + "0", "", http.StatusUnauthorized},
+		{"token of another job", "other-job", "?token=" + token, "", http.StatusUnauthorized},
+		{"bearer of another client", "streamed-job", "?token=" + token, "tb", http.StatusNotFound},
+		{"bearer of the owner", "streamed-job", "", "ta", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/jobs/"+tt.id+"/events"+tt.query, nil)
+		r.SetPathValue("id", tt.id)
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: code = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// openApplicationDB opens <source.Path>/application.db with the source's
+// backend, or with the backend sniffed from the files on disk when none is
+// set. Read-only sources are opened without write access.
+func openApplicationDB(source *DataSource) (dbm.DB, dbm.BackendType, error) {
+	dataDir := source.Path
+	backendType := dbm.BackendType(source.Backend)
+	if source.Backend == "" {
+		detected, err := detectBackend(filepath.Join(dataDir, "application.db"))
+		if err != nil {
+			return nil, "", err
+		}
+		backendType = detected
+	}
+
+	var db dbm.DB
+	var err error
+	if source.ReadOnly {
+		if backendType != dbm.GoLevelDBBackend {
+			return nil, backendType, fmt.Errorf("%s uses %s, which cannot be opened read-only in place; use mode \"link\" or \"copy\"", dataDir, backendType)
+		}
+		db, err = dbm.NewGoLevelDBWithOpts("application", dataDir, &opt.Options{ReadOnly: true})
+	} else {
+		db, err = dbm.NewDB("application", backendType, dataDir)
+	}
+	if err != nil {
+		if backendType == dbm.RocksDBBackend && strings.Contains(err.Error(), "unknown db_backend") {
+			return nil, backendType, fmt.Errorf("%s uses rocksdb, but this binary was built without rocksdb support (rebuild with -tags rocksdb)", dataDir)
+		}
+		return nil, backendType, fmt.Errorf("error opening %s database in %s: %v", backendType, dataDir, err)
+	}
+	return db, backendType, nil
+}
+
+// detectBackend guesses which cosmos-db backend wrote dbDir. Pebble and
+// RocksDB both keep an OPTIONS-* file that names the engine; goleveldb has no
+// OPTIONS file but still writes CURRENT/MANIFEST-* like the others.
+func detectBackend(dbDir string) (dbm.BackendType, error) {
+	entries, err := os.ReadDir(dbDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read database directory %s: %v", dbDir, err)
+	}
+
+	var hasCurrent, hasManifest, hasIdentity, hasLDB bool
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasPrefix(name, "OPTIONS-"):
+			data, err := os.ReadFile(filepath.Join(dbDir, name))
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %v", name, err)
+			}
+			if bytes.Contains(data, []byte("pebble_version")) {
+				return dbm.PebbleDBBackend, nil
+			}
+			if bytes.Contains(data, []byte("rocksdb_version")) {
+				return dbm.RocksDBBackend, nil
+			}
+		case strings.HasPrefix(name, "marker.format-version."):
+			return dbm.PebbleDBBackend, nil
+		case name == "IDENTITY":
+			hasIdentity = true
+		case name == "CURRENT":
+			hasCurrent = true
+		case strings.HasPrefix(name, "MANIFEST-"):
+			hasManifest = true
+		case strings.HasSuffix(name, ".ldb"):
+			hasLDB = true
+		}
+	}
+
+	switch {
+	case hasIdentity:
+		return dbm.RocksDBBackend, nil
+	case hasCurrent && (hasManifest || hasLDB):
+		return dbm.GoLevelDBBackend, nil
+	default:
+		return "", fmt.Errorf("could not detect the database backend of %s; set \"backend\" on the source explicitly", dbDir)
+	}
+}
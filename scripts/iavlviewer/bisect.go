@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	storetypes "cosmossdk.io/store/types"
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+type BisectResult struct {
+	CommonFrom int64 `json:"common_from"`
+	CommonTo   int64 `json:"common_to"`
+	// FirstDivergentHeight is a height where store hashes differ while they
+	// agree at LastMatchingHeight, the common height before it. Divergence
+	// is normally sticky, which makes it the first one, but stores that
+	// converge again can hide an earlier divergence from the bisection.
+	FirstDivergentHeight int64             `json:"first_divergent_height,omitempty"`
+	LastMatchingHeight   int64             `json:"last_matching_height,omitempty"`
+	HeightsChecked       int               `json:"heights_checked"`
+	DivergedStores       []StoreComparison `json:"diverged_stores,omitempty"`
+	Note                 string            `json:"note,omitempty"`
+}
+
+// noSharedHeightsError is a bisection between sources that retain no common
+// height; only other sources can fix it.
+type noSharedHeightsError struct {
+	Source1, Source2 string
+}
+
+func (e *noSharedHeightsError) Error() string {
+	return fmt.Sprintf("sources share no committed heights (source1: %s; source2: %s)", e.Source1, e.Source2)
+}
+
+// bisectStores binary-searches the commit infos both DBs retain for the first
+// height at which any store hash differs. Only commit infos are read, so this
+// also works across heights whose IAVL trees have been pruned. The result is
+// always bracketed: hashes differ at FirstDivergentHeight and agree at
+// LastMatchingHeight.
+func bisectStores(ctx context.Context, source1, source2 *DataSource) (*BisectResult, error) {
+	db1, _, err := openApplicationDB(source1)
+	if err != nil {
+		return nil, fmt.Errorf("source1: %v", err)
+	}
+	defer db1.Close()
+
+	db2, _, err := openApplicationDB(source2)
+	if err != nil {
+		return nil, fmt.Errorf("source2: %v", err)
+	}
+	defer db2.Close()
+
+	versions1, err := listCommitVersions(db1)
+	if err != nil {
+		return nil, fmt.Errorf("error listing commit infos for source1: %v", err)
+	}
+	versions2, err := listCommitVersions(db2)
+	if err != nil {
+		return nil, fmt.Errorf("error listing commit infos for source2: %v", err)
+	}
+
+	common := intersectVersions(versions1, versions2)
+	if len(common) == 0 {
+		return nil, &noSharedHeightsError{
+			Source1: formatVersionRanges(compactVersions(versions1)),
+			Source2: formatVersionRanges(compactVersions(versions2)),
+		}
+	}
+
+	result := &BisectResult{
+		CommonFrom: common[0],
+		CommonTo:   common[len(common)-1],
+	}
+
+	var firstErr error
+	diverged := func(i int) bool {
+		if firstErr != nil {
+			return true
+		}
+		if firstErr = ctx.Err(); firstErr != nil {
+			return true
+		}
+		result.HeightsChecked++
+		stores, err := diffCommitInfos(db1, db2, common[i])
+		if err != nil {
+			firstErr = err
+			return true
+		}
+		return len(stores) > 0
+	}
+
+	// Divergence is normally sticky, making the predicate monotonic over the
+	// common heights. It isn't when a diverged store is later rewritten to
+	// the same contents in both sources; the search then still ends between
+	// an agreeing and a diverging height, since sort.Search only returns idx
+	// after finding the predicate false at idx-1, but an earlier divergent
+	// range may go unseen.
+	idx := sort.Search(len(common), diverged)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if idx == len(common) {
+		result.LastMatchingHeight = result.CommonTo
+		result.Note = fmt.Sprintf("no divergence found in common heights %d-%d", result.CommonFrom, result.CommonTo)
+		return result, nil
+	}
+
+	result.FirstDivergentHeight = common[idx]
+	result.DivergedStores, err = diffCommitInfos(db1, db2, common[idx])
+	if err != nil {
+		return nil, err
+	}
+	if idx == 0 {
+		result.Note = fmt.Sprintf("sources already differ at the earliest common height %d; divergence happened at or before it", common[0])
+	} else {
+		result.LastMatchingHeight = common[idx-1]
+		if common[idx-1]+1 != common[idx] {
+			result.Note = fmt.Sprintf("heights %d-%d are not retained by both sources; divergence happened somewhere in that gap", common[idx-1]+1, common[idx])
+		}
+	}
+	return result, nil
+}
+
+// diffCommitInfos returns the stores whose hashes differ between the two
+// commit infos at the given height, sorted by store name.
+func diffCommitInfos(db1, db2 dbm.DB, ver int64) ([]StoreComparison, error) {
+	cInfo1, err := loadCommitInfo(db1, ver)
+	if err != nil {
+		return nil, fmt.Errorf("source1: %v", err)
+	}
+	cInfo2, err := loadCommitInfo(db2, ver)
+	if err != nil {
+		return nil, fmt.Errorf("source2: %v", err)
+	}
+
+	stores1 := storeHashes(cInfo1)
+	stores2 := storeHashes(cInfo2)
+
+	var diffs []StoreComparison
+	for name, h1 := range stores1 {
+		h2, ok := stores2[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, StoreComparison{Name: name, Status: "missing_source2", Hash1: fmt.Sprintf("%x", h1)})
+		case !bytes.Equal(h1, h2):
+			diffs = append(diffs, StoreComparison{Name: name, Status: "differ", Hash1: fmt.Sprintf("%x", h1), Hash2: fmt.Sprintf("%x", h2)})
+		}
+	}
+	for name, h2 := range stores2 {
+		if _, ok := stores1[name]; !ok {
+			diffs = append(diffs, StoreComparison{Name: name, Status: "missing_source1", Hash2: fmt.Sprintf("%x", h2)})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs, nil
+}
+
+func storeHashes(cInfo *storetypes.CommitInfo) map[string][]byte {
+	hashes := make(map[string][]byte, len(cInfo.StoreInfos))
+	for _, s := range cInfo.StoreInfos {
+		hashes[s.Name] = s.GetHash()
+	}
+	return hashes
+}
+
+// intersectVersions merges two ascending height lists into their common set.
+func intersectVersions(a, b []int64) []int64 {
+	var common []int64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			common = append(common, a[i])
+			i++
+			j++
+		}
+	}
+	return common
+}
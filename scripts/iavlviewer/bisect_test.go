@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// commitInfoSource writes an application.db that only holds commit info keys
+// for heights.
+func commitInfoSource(t *testing.T, heights ...int64) *DataSource {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := dbm.NewGoLevelDB("application", dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range heights {
+		if err := db.Set([]byte(fmt.Sprintf("s/%d", h)), []byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &DataSource{Path: dir, Backend: string(dbm.GoLevelDBBackend)}
+}
+
+func TestBisectWithoutSharedHeights(t *testing.T) {
+	_, err := bisectStores(context.Background(), commitInfoSource(t, 1, 2), commitInfoSource(t, 5, 6))
+	if errorType(err) != ErrorTypeInvalidInput {
+		t.Fatalf("errorType(%v) = %q, want %q", err, errorType(err), ErrorTypeInvalidInput)
+	}
+	if code := failureStatus(CompareResponse{ErrorType: errorType(err)}); code != http.StatusUnprocessableEntity {
+		t.Errorf("failureStatus = %d, want 422", code)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// sourceCache keeps extracted archive sources on disk, keyed by the archive's
+// sha256 or by URL and ETag, so repeated comparisons against the same snapshot
+// skip the download and extraction. Entries in use are reference counted;
+// idle ones are evicted after maxAge (--cache-max-age) and, least recently
+// used first, once the cache exceeds maxSize (--cache-max-size).
+type sourceCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is a prepared source below <cache dir>/<id>/data. Its metadata
+// is kept next to it in entry.json so the cache survives restarts.
+type cacheEntry struct {
+	Key       string    `json:"key"`
+	Source    string    `json:"source"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+
+	dir  string
+	refs int
+	// ready is closed once the entry is prepared or has failed with err.
+	ready    chan struct{}
+	prepared bool
+	err      error
+}
+
+// preparedCache is nil when caching is disabled, which is always the case in
+// CLI mode.
+var preparedCache *sourceCache
+
+func (e *cacheEntry) dataDir() string {
+	return filepath.Join(e.dir, "data")
+}
+
+// openSourceCache loads the entries left in dir by a previous run and
+// removes anything that was not completely prepared.
+func openSourceCache(dir string, maxSize int64, maxAge time.Duration) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir %s: %v", dir, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache dir %s: %v", dir, err)
+	}
+	c := &sourceCache{dir: dir, maxSize: maxSize, maxAge: maxAge, entries: map[string]*cacheEntry{}}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		e, err := loadCacheEntry(path)
+		if err != nil || cacheEntryID(e.Key) != f.Name() {
+			os.RemoveAll(path)
+			continue
+		}
+		c.entries[e.Key] = e
+	}
+	preparedCache = c
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return nil
+}
+
+func loadCacheEntry(dir string) (*cacheEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "entry.json"))
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	e.dir = dir
+	e.ready = make(chan struct{})
+	close(e.ready)
+	e.prepared = true
+	return e, nil
+}
+
+func (e *cacheEntry) save() error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.dir, "entry.json"), data, 0644)
+}
+
+// cacheEntryID names the directory of a key; keys contain URLs, so they are
+// hashed rather than used as paths.
+func cacheEntryID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// acquire returns the prepared entry for key, calling prepare to fill it on a
+// miss. Concurrent requests for the same key wait for a single preparation.
+// hit reports whether the entry was prepared by someone else. The caller must
+// release the entry when done with it.
+func (c *sourceCache) acquire(ctx context.Context, key, label string, prepare func(dir string) error) (e *cacheEntry, hit bool, err error) {
+	for {
+		c.mu.Lock()
+		e = c.entries[key]
+		if e == nil {
+			e = &cacheEntry{Key: key, Source: label, dir: filepath.Join(c.dir, cacheEntryID(key)), refs: 1, ready: make(chan struct{})}
+			c.entries[key] = e
+			c.mu.Unlock()
+			return e, false, c.fill(e, prepare)
+		}
+		e.refs++
+		e.LastUsed = time.Now().UTC()
+		c.mu.Unlock()
+
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			c.release(e)
+			return nil, false, ctx.Err()
+		}
+		if e.err == nil {
+			return e, true, nil
+		}
+		c.release(e)
+		// Only a cancelled preparation is worth repeating for another job.
+		if !errors.Is(e.err, context.Canceled) && !errors.Is(e.err, context.DeadlineExceeded) {
+			return nil, false, e.err
+		}
+	}
+}
+
+// fill prepares e in a temporary directory and moves it into place, so a
+// crash never leaves a half-extracted entry behind.
+func (c *sourceCache) fill(e *cacheEntry, prepare func(dir string) error) error {
+	tmpDir := e.dir + ".tmp"
+	os.RemoveAll(tmpDir)
+	err := os.MkdirAll(tmpDir, 0755)
+	if err == nil {
+		err = prepare(filepath.Join(tmpDir, "data"))
+	}
+	if err == nil {
+		e.Size, err = dirSize(context.Background(), tmpDir)
+	}
+	if err == nil {
+		e.CreatedAt = time.Now().UTC()
+		e.LastUsed = e.CreatedAt
+		final := e.dir
+		e.dir = tmpDir
+		err = e.save()
+		e.dir = final
+	}
+	if err == nil {
+		err = os.Rename(tmpDir, e.dir)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		delete(c.entries, e.Key)
+		e.err = err
+		e.refs--
+	} else {
+		e.prepared = true
+		fmt.Printf("[INFO] Cached %s (%d bytes) as %s\n", e.Source, e.Size, filepath.Base(e.dir))
+		c.evictLocked()
+	}
+	close(e.ready)
+	return err
+}
+
+// holds reports whether key is already prepared in the cache.
+func (c *sourceCache) holds(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	return e != nil && e.prepared
+}
+
+// release drops a reference to e and evicts whatever the policy allows now
+// that it may be idle.
+func (c *sourceCache) release(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refs--
+	if e.refs == 0 && e.prepared {
+		e.LastUsed = time.Now().UTC()
+		e.save()
+	}
+	c.evictLocked()
+}
+
+// evictLocked removes idle entries that are older than maxAge, then the least
+// recently used idle entries until the cache fits in maxSize. Entries in use
+// are never removed, so the cache may exceed maxSize while they are.
+func (c *sourceCache) evictLocked() {
+	var total int64
+	var idle []*cacheEntry
+	for _, e := range c.entries {
+		if !e.prepared {
+			continue
+		}
+		total += e.Size
+		if e.refs == 0 {
+			idle = append(idle, e)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].LastUsed.Before(idle[j].LastUsed) })
+
+	for _, e := range idle {
+		expired := c.maxAge > 0 && time.Since(e.LastUsed) > c.maxAge
+		oversize := c.maxSize > 0 && total > c.maxSize
+		if !expired && !oversize {
+			continue
+		}
+		delete(c.entries, e.Key)
+		total -= e.Size
+		// Move the entry out of the way first, so the key can be prepared
+		// again while the old files are still being deleted.
+		trash := e.dir + ".evicted-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := os.Rename(e.dir, trash); err != nil {
+			trash = e.dir
+		}
+		go os.RemoveAll(trash)
+		fmt.Printf("[INFO] Evicted cached %s (%d bytes)\n", e.Source, e.Size)
+	}
+}
+
+// pruneSourceCache applies the age limit to idle entries every interval.
+func pruneSourceCache(interval time.Duration) {
+	for range time.Tick(interval) {
+		preparedCache.mu.Lock()
+		preparedCache.evictLocked()
+		preparedCache.mu.Unlock()
+	}
+}
+
+// dirSize sums the regular files below dir, giving up once ctx is done.
+func dirSize(ctx context.Context, dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// sourceCacheKey identifies the content of an archive source. A known sha256
+// is used directly, so the same archive shares one entry however it is
+// supplied; URLs are otherwise keyed by their ETag (or Last-Modified and
+// length) and files by path, size and modification time. An empty key means
+// the source can't be identified and isn't cached.
+func sourceCacheKey(ctx context.Context, req DataSourceRequest) (string, error) {
+	if req.Type == "upload" {
+		actual := fmt.Sprintf("%x", sha256.Sum256(req.Data))
+		if req.SHA256 != "" && !strings.EqualFold(actual, req.SHA256) {
+			return "", &checksumMismatchError{Expected: strings.ToLower(req.SHA256), Actual: actual}
+		}
+		return "sha256:" + actual, nil
+	}
+	if req.SHA256 != "" {
+		return "sha256:" + strings.ToLower(req.SHA256), nil
+	}
+
+	switch req.Type {
+	case "archive_file", "zip_file":
+		path, err := filepath.Abs(req.Path)
+		if err != nil {
+			return "", err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("file:%s\n%d\n%d", path, info.Size(), info.ModTime().UnixNano()), nil
+
+	case "archive_url", "zip_url":
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodHead, req.URL, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := sourceHTTPClient.Do(httpReq)
+		if err != nil {
+			// Let the download report the problem, with its retries.
+			return "", nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", nil
+		}
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			return "url:" + req.URL + "\netag:" + etag, nil
+		}
+		if lm := resp.Header.Get("Last-Modified"); lm != "" && resp.ContentLength > 0 {
+			return fmt.Sprintf("url:%s\nmodified:%s\n%d", req.URL, lm, resp.ContentLength), nil
+		}
+	}
+	return "", nil
+}
+
+// prepareFromCache serves an archive source from the cache, preparing it
+// there first on a miss. ok is false when caching is off or the source can't
+// be identified, and the caller should prepare it itself.
+//
+// goleveldb sources are opened read-only straight from the cache; other
+// backends can't be, so they get a reflink/hardlink clone in targetDir.
+func prepareFromCache(ctx context.Context, req DataSourceRequest, targetDir string, progress progressFunc) (source *DataSource, ok bool, err error) {
+	if preparedCache == nil {
+		return nil, false, nil
+	}
+	key, err := sourceCacheKey(ctx, req)
+	if err != nil {
+		return nil, true, err
+	}
+	if key == "" {
+		return nil, false, nil
+	}
+
+	label := sourceLabel(req)
+	e, hit, err := preparedCache.acquire(ctx, key, label, func(dir string) error {
+		return extractSource(ctx, req, dir, progress)
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	if hit {
+		fmt.Printf("[INFO] Using cached %s\n", label)
+		progress.report(ProgressEvent{Event: EventCacheHit})
+	}
+
+	dbDir := findDBDir(e.dataDir())
+	backend := dbm.BackendType(req.Backend)
+	if backend == "" {
+		if backend, err = detectBackend(filepath.Join(dbDir, "application.db")); err != nil {
+			preparedCache.release(e)
+			return nil, true, err
+		}
+	}
+	if backend == dbm.GoLevelDBBackend {
+		fmt.Printf("[INFO] Final data directory used for comparison: %s\n", dbDir)
+		return &DataSource{Path: dbDir, Backend: string(backend), ReadOnly: true, cached: e}, true, nil
+	}
+
+	// The clone doesn't depend on the entry, so it can be evicted right away.
+	defer preparedCache.release(e)
+	if _, _, _, err := cloneDir(ctx, e.dataDir(), targetDir); err != nil {
+		return nil, true, fmt.Errorf("failed to clone cached source: %v", err)
+	}
+	finalDir := findDBDir(targetDir)
+	fmt.Printf("[INFO] Final data directory used for comparison: %s\n", finalDir)
+	return &DataSource{Path: finalDir, Backend: string(backend)}, true, nil
+}
+
+// releaseSource gives back the cache entry a prepared source reads from.
+func releaseSource(source *DataSource) {
+	if source != nil && source.cached != nil {
+		preparedCache.release(source.cached)
+		source.cached = nil
+	}
+}
+
+// parseByteSize parses a size such as "500M" or "50G" (binary units) or a
+// plain number of bytes.
+func parseByteSize(s string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := int64(1)
+	if n := len(num); n > 0 {
+		if u, ok := units[num[n-1:]]; ok {
+			mult = u
+			num = num[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
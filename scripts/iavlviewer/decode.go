@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// FieldChange is a field that differs between the decoded values of a key.
+type FieldChange struct {
+	// Path is the field's location, e.g. "commission.rate" or
+	// "coins[0].amount"; it is empty when the values are scalars.
+	Path string `json:"path"`
+	// Old and New are the field's JSON values; one is missing when the
+	// field only exists on one side.
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// String renders the change as "path: old -> new", with strings unquoted.
+func (c FieldChange) String() string {
+	path := c.Path
+	if path == "" {
+		path = "(value)"
+	}
+	return fmt.Sprintf("%s: %s -> %s", path, formatFieldValue(c.Old), formatFieldValue(c.New))
+}
+
+func formatFieldValue(v json.RawMessage) string {
+	if v == nil {
+		return "(absent)"
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	return string(v)
+}
+
+// differenceDecoder renders the keys and values of differences in a
+// readable form, as configured by the comparison's options.
+type differenceDecoder struct {
+	// chain selects the key and value layouts; empty until detected.
+	chain        string
+	bech32Prefix string
+	proto        *protoRegistry
+	// protoTypes are the ProtoTypes rules, most specific first.
+	protoTypes []protoTypeRule
+}
+
+// protoTypeRule maps the values of a store, or of the keys under a prefix
+// (given as hex or as the decoded prefix name), to a message type.
+type protoTypeRule struct {
+	store      string
+	prefix     []byte
+	prefixName string
+	message    string
+}
+
+// specificity orders rules: longer hex prefixes first, then prefix names,
+// then whole stores.
+func (r protoTypeRule) specificity() int {
+	if r.prefixName != "" {
+		return 1
+	}
+	return 2 * len(r.prefix)
+}
+
+func newDifferenceDecoder(options CompareOptions) (*differenceDecoder, error) {
+	d := &differenceDecoder{chain: options.Chain, bech32Prefix: options.Bech32Prefix}
+	if d.chain != "" && d.chain != chainCosmos && d.chain != chainHeimdall {
+		return nil, fmt.Errorf("unknown chain %q: expected %s or %s", d.chain, chainCosmos, chainHeimdall)
+	}
+	if options.ProtoDescriptors == "" && options.ProtoDescriptorSet == nil {
+		if len(options.ProtoTypes) > 0 {
+			return nil, fmt.Errorf("proto_types needs proto_descriptors or proto_descriptor_set")
+		}
+		return d, nil
+	}
+	reg, err := loadProtoRegistry(options.ProtoDescriptors, options.ProtoDescriptorSet)
+	if err != nil {
+		return nil, err
+	}
+	d.proto = reg
+
+	for pattern, message := range options.ProtoTypes {
+		rule := protoTypeRule{message: message}
+		var prefix string
+		rule.store, prefix, _ = strings.Cut(pattern, "/")
+		if rule.store == "" {
+			return nil, fmt.Errorf("invalid proto_types entry %q: expected store or store/prefix", pattern)
+		}
+		if b, err := hex.DecodeString(prefix); err == nil {
+			rule.prefix = b
+		} else {
+			rule.prefixName = prefix
+		}
+		if _, err := reg.FindMessageByName(protoreflect.FullName(message)); err != nil {
+			return nil, fmt.Errorf("proto_types entry %q: unknown message type %s", pattern, message)
+		}
+		d.protoTypes = append(d.protoTypes, rule)
+	}
+	sort.Slice(d.protoTypes, func(i, j int) bool {
+		a, b := d.protoTypes[i], d.protoTypes[j]
+		if a.specificity() != b.specificity() {
+			return a.specificity() > b.specificity()
+		}
+		return a.store+"/"+string(a.prefix)+a.prefixName < b.store+"/"+string(b.prefix)+b.prefixName
+	})
+	return d, nil
+}
+
+// decode fills in the decoded keys and values of a store's differences.
+// External decoders give up on a value once ctx ends.
+func (d *differenceDecoder) decode(ctx context.Context, storeName string, diffs []StoreDifference) {
+	for i := range diffs {
+		diff := &diffs[i]
+		key, err := hex.DecodeString(diff.KeyHex)
+		if err != nil {
+			continue
+		}
+		chain := d.chain
+		if chain == "" {
+			chain = chainCosmos
+		}
+		diff.DecodedKey = decodeStoreKey(chain, storeName, key, d.bech32Prefix)
+		if message := d.messageType(storeName, key, diff.DecodedKey); message != "" {
+			d.decodeProtoValues(diff, message)
+		} else if plugin := decoderPlugins[storeName]; plugin != nil {
+			plugin.decodeValues(ctx, diff)
+		} else if chain != chainHeimdall || !decodeHeimdallValues(storeName, diff) {
+			decodeJSONValues(storeName, diff)
+		}
+		if chain == chainHeimdall {
+			describeHeimdallDifference(storeName, diff)
+		}
+	}
+}
+
+// messageType returns the message the values under key are decoded as, or ""
+// if no rule matches.
+func (d *differenceDecoder) messageType(storeName string, key []byte, decoded *DecodedKey) string {
+	for _, rule := range d.protoTypes {
+		if rule.store != storeName {
+			continue
+		}
+		switch {
+		case rule.prefixName != "":
+			if decoded != nil && decoded.Prefix == rule.prefixName {
+				return rule.message
+			}
+		case bytes.HasPrefix(key, rule.prefix):
+			return rule.message
+		}
+	}
+	return ""
+}
+
+func (d *differenceDecoder) decodeProtoValues(diff *StoreDifference, message string) {
+	diff.ValueType = message
+	var errs []string
+	if diff.Type != "key_only_source2" {
+		value, _ := hex.DecodeString(diff.Value1Hex)
+		decoded, err := d.proto.decodeMessage(message, value)
+		if err != nil {
+			errs = append(errs, "value1: "+err.Error())
+		}
+		diff.Value1Decoded = decoded
+	}
+	if diff.Type != "key_only_source1" {
+		value, _ := hex.DecodeString(diff.Value2Hex)
+		decoded, err := d.proto.decodeMessage(message, value)
+		if err != nil {
+			errs = append(errs, "value2: "+err.Error())
+		}
+		diff.Value2Decoded = decoded
+	}
+	diff.DecodeError = strings.Join(errs, "; ")
+	if diff.Value1Decoded != nil && diff.Value2Decoded != nil {
+		diff.FieldChanges = diffJSON(diff.Value1Decoded, diff.Value2Decoded)
+	}
+}
+
+// Value types of differences whose values are JSON already.
+const (
+	valueTypeJSON      = "json"
+	valueTypeAminoJSON = "amino_json"
+)
+
+// decodeJSONValues takes values that are JSON documents as decoded. Any
+// store may hold JSON objects or arrays; the params store holds amino JSON,
+// where plain strings and numbers are values too.
+func decodeJSONValues(storeName string, diff *StoreDifference) {
+	valueType := valueTypeJSON
+	if storeName == "params" {
+		valueType = valueTypeAminoJSON
+	}
+	var values [2]json.RawMessage
+	for i, side := range []struct {
+		present bool
+		hex     string
+	}{
+		{diff.Type != "key_only_source2", diff.Value1Hex},
+		{diff.Type != "key_only_source1", diff.Value2Hex},
+	} {
+		if !side.present {
+			continue
+		}
+		value, err := hex.DecodeString(side.hex)
+		if err != nil || !json.Valid(value) {
+			return
+		}
+		if trimmed := bytes.TrimSpace(value); valueType == valueTypeJSON && (len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[')) {
+			return
+		}
+		var compact bytes.Buffer
+		json.Compact(&compact, value)
+		values[i] = compact.Bytes()
+	}
+	diff.ValueType = valueType
+	diff.Value1Decoded, diff.Value2Decoded = values[0], values[1]
+	if values[0] != nil && values[1] != nil {
+		diff.FieldChanges = diffJSON(values[0], values[1])
+	}
+}
+
+// diffJSON lists the fields that differ between two JSON documents. Objects
+// are compared by key and arrays by index.
+func diffJSON(a, b json.RawMessage) []FieldChange {
+	va, errA := unmarshalJSONValue(a)
+	vb, errB := unmarshalJSONValue(b)
+	if errA != nil || errB != nil {
+		return nil
+	}
+	var changes []FieldChange
+	diffJSONValues("", va, vb, &changes)
+	return changes
+}
+
+func unmarshalJSONValue(data json.RawMessage) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// jsonAbsent marks a field that only one side has.
+type jsonAbsent struct{}
+
+func diffJSONValues(path string, a, b any, changes *[]FieldChange) {
+	switch va := a.(type) {
+	case map[string]any:
+		if vb, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(va)+len(vb))
+			for k := range va {
+				keys = append(keys, k)
+			}
+			for k := range vb {
+				if _, ok := va[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				diffJSONValues(joinFieldPath(path, k), jsonField(va, k), jsonField(vb, k), changes)
+			}
+			return
+		}
+	case []any:
+		if vb, ok := b.([]any); ok {
+			for i := 0; i < max(len(va), len(vb)); i++ {
+				diffJSONValues(path+"["+strconv.Itoa(i)+"]", jsonIndex(va, i), jsonIndex(vb, i), changes)
+			}
+			return
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+	*changes = append(*changes, FieldChange{Path: path, Old: marshalJSONValue(a), New: marshalJSONValue(b)})
+}
+
+func jsonField(m map[string]any, k string) any {
+	if v, ok := m[k]; ok {
+		return v
+	}
+	return jsonAbsent{}
+}
+
+func jsonIndex(s []any, i int) any {
+	if i < len(s) {
+		return s[i]
+	}
+	return jsonAbsent{}
+}
+
+func marshalJSONValue(v any) json.RawMessage {
+	if _, ok := v.(jsonAbsent); ok {
+		return nil
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func joinFieldPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	storetypes "cosmossdk.io/store/types"
+)
+
+const (
+	defaultDifferencePageSize = 100
+	maxDifferencePageSize     = 1000
+)
+
+type DifferencePage struct {
+	Success      bool              `json:"success"`
+	Error        string            `json:"error,omitempty"`
+	ComparisonID string            `json:"comparison_id"`
+	Store        string            `json:"store"`
+	Differences  []StoreDifference `json:"differences"`
+	// NextCursor is the key hex of the last difference on this page; pass it
+	// back as ?cursor= to continue. It is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// retainedComparison keeps the prepared inputs of a finished comparison on
+// disk so its differences can be paged through afterwards.
+type retainedComparison struct {
+	// mu serializes readers: a LevelDB directory can only be opened once.
+	mu                 sync.Mutex
+	source1, source2   *DataSource
+	version1, version2 int64
+	options            CompareOptions
+	inputDir           string
+	expiresAt          time.Time
+	// owner is the client that ran the comparison; see requestOwner.
+	owner string
+}
+
+var (
+	retainedMu          sync.Mutex
+	retainedComparisons = map[string]*retainedComparison{}
+	// sourceRetention is how long server mode keeps prepared sources after a
+	// comparison finishes. Zero removes them immediately, as the CLI does.
+	sourceRetention time.Duration
+)
+
+// retainComparison registers a finished comparison for paging. It returns
+// false when retention is disabled and the caller should clean up itself.
+func retainComparison(id string, rc *retainedComparison) bool {
+	if sourceRetention <= 0 {
+		return false
+	}
+	rc.expiresAt = time.Now().Add(sourceRetention)
+	retainedMu.Lock()
+	retainedComparisons[id] = rc
+	retainedMu.Unlock()
+	return true
+}
+
+func lookupRetainedComparison(id string) *retainedComparison {
+	retainedMu.Lock()
+	defer retainedMu.Unlock()
+	rc := retainedComparisons[id]
+	if rc == nil || time.Now().After(rc.expiresAt) {
+		return nil
+	}
+	return rc
+}
+
+// pruneRetainedComparisons removes expired inputs every interval. Entries
+// that are being read are left for the next pass.
+func pruneRetainedComparisons(interval time.Duration) {
+	for range time.Tick(interval) {
+		retainedMu.Lock()
+		for id, rc := range retainedComparisons {
+			if time.Now().Before(rc.expiresAt) || !rc.mu.TryLock() {
+				continue
+			}
+			delete(retainedComparisons, id)
+			os.RemoveAll(rc.inputDir)
+			releaseSource(rc.source1)
+			releaseSource(rc.source2)
+			rc.mu.Unlock()
+			fmt.Printf("[INFO] Removed expired inputs of comparison %s\n", id)
+		}
+		retainedMu.Unlock()
+	}
+}
+
+func handleDifferencesAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[Differences] %s %s from %s\n", r.Method, r.URL.String(), r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	page := DifferencePage{
+		ComparisonID: r.PathValue("id"),
+		Store:        r.URL.Query().Get("store"),
+	}
+	fail := func(status int, msg string) {
+		page.Error = msg
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(page)
+	}
+
+	if r.Method != http.MethodGet {
+		fail(http.StatusMethodNotAllowed, "Method not allowed. Use GET.")
+		return
+	}
+	if page.Store == "" {
+		fail(http.StatusBadRequest, "Missing store query parameter")
+		return
+	}
+	var after []byte
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var err error
+		if after, err = hex.DecodeString(cursor); err != nil {
+			fail(http.StatusBadRequest, fmt.Sprintf("Invalid cursor: %v", err))
+			return
+		}
+	}
+	limit := defaultDifferencePageSize
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			fail(http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxDifferencePageSize)
+	}
+
+	rc := lookupRetainedComparison(page.ComparisonID)
+	if rc == nil || rc.owner != requestOwner(r) {
+		fail(http.StatusNotFound, "Comparison not found or its sources have expired")
+		return
+	}
+
+	rc.mu.Lock()
+	diffs, hasMore, err := loadDifferencePage(r.Context(), rc, page.Store, after, limit)
+	rc.mu.Unlock()
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	page.Success = true
+	page.Differences = diffs
+	page.HasMore = hasMore
+	if hasMore {
+		page.NextCursor = diffs[len(diffs)-1].KeyHex
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func loadDifferencePage(ctx context.Context, rc *retainedComparison, storeName string, after []byte, limit int) ([]StoreDifference, bool, error) {
+	decoder, err := newDifferenceDecoder(rc.options)
+	if err != nil {
+		return nil, false, err
+	}
+	src1, err := loadStoreSource(rc.source1, rc.version1)
+	if err != nil {
+		return nil, false, fmt.Errorf("source1: %v", err)
+	}
+	defer src1.db.Close()
+	src2, err := loadStoreSource(rc.source2, rc.version2)
+	if err != nil {
+		return nil, false, fmt.Errorf("source2: %v", err)
+	}
+	defer src2.db.Close()
+	diffs, hasMore, err := getStoreDifferencePage(ctx, src1, src2, storeName, after, limit)
+	decoder.decode(ctx, storeName, diffs)
+	return diffs, hasMore, err
+}
+
+// loadStoreSource opens a prepared source and loads every store listed in its
+// commit info at version.
+func loadStoreSource(source *DataSource, version int64) (storeSource, error) {
+	db, _, err := openApplicationDB(source)
+	if err != nil {
+		return storeSource{}, err
+	}
+	ms := newMultiStore(db, source)
+	cInfo, err := loadCommitInfo(db, version)
+	if err != nil {
+		db.Close()
+		return storeSource{}, err
+	}
+	for _, si := range cInfo.StoreInfos {
+		ms.MountStoreWithDB(storetypes.NewKVStoreKey(si.Name), storetypes.StoreTypeIAVL, nil)
+	}
+	if err := ms.LoadVersion(version); err != nil {
+		db.Close()
+		return storeSource{}, fmt.Errorf("error loading height %d: %v", version, err)
+	}
+	return storeSource{db: db, ms: ms, version: version}, nil
+}
+
+// getStoreDifferencePage returns up to limit differences with keys after the
+// given one, using the same diff walks as getStoreDifferences, and whether
+// more remain.
+func getStoreDifferencePage(ctx context.Context, src1, src2 storeSource, storeName string, after []byte, limit int) ([]StoreDifference, bool, error) {
+	s1 := src1.ms.GetStoreByName(storeName)
+	s2 := src2.ms.GetStoreByName(storeName)
+	if s1 == nil || s2 == nil {
+		return nil, false, fmt.Errorf("store %s is not present in both sources", storeName)
+	}
+
+	var page []StoreDifference
+	emit := func(diff StoreDifference) bool {
+		page = append(page, diff)
+		return len(page) <= limit
+	}
+
+	if s1.GetStoreType() == storetypes.StoreTypeIAVL && s2.GetStoreType() == storetypes.StoreTypeIAVL {
+		r1 := newIAVLNodeReader(src1.db, storeName)
+		r2 := newIAVLNodeReader(src2.db, storeName)
+		if _, err := diffIAVLTrees(ctx, r1, r2, src1.version, src2.version, after, emit); err != nil {
+			return nil, false, err
+		}
+	} else if kv1, ok := s1.(storetypes.KVStore); ok {
+		kv2, ok := s2.(storetypes.KVStore)
+		if !ok {
+			return nil, false, fmt.Errorf("store %s cannot be iterated in source2", storeName)
+		}
+		if err := compareKVStoresForAPI(ctx, kv1, kv2, after, emit); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if len(page) > limit {
+		return page[:limit], true, nil
+	}
+	return page, false, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+// diskFree is not implemented on this platform, so free-space checks are
+// skipped.
+func diskFree(path string) (free int64, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// downloadDir keeps partial downloads across jobs and restarts, so a
+	// download that ran out of retries or was cancelled resumes where it
+	// stopped the next time the same URL is requested. CLI mode leaves it
+	// empty and downloads next to the destination instead.
+	downloadDir string
+	// downloadRetention is how long an unused partial download is kept.
+	downloadRetention = 24 * time.Hour
+	// downloadLocks holds the partial downloads in use; the channel is closed
+	// when the holder is done.
+	downloadLocksMu sync.Mutex
+	downloadLocks   = map[string]chan struct{}{}
+
+	// downloadRetries is how many times a failed download is resumed before
+	// giving up.
+	downloadRetries = 5
+	// downloadBackoff is the wait before the first retry; it doubles on each
+	// further retry up to maxDownloadBackoff.
+	downloadBackoff = 2 * time.Second
+)
+
+const (
+	maxDownloadBackoff = time.Minute
+	// downloadStallTimeout aborts an attempt that has received no data for
+	// this long, so a hung connection turns into a retry.
+	downloadStallTimeout = 2 * time.Minute
+)
+
+// checksumMismatchError reports an archive whose sha256 differs from the one
+// given in the source request.
+type checksumMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("sha256 mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// httpStatusError is a download response with an unexpected status code.
+type httpStatusError struct {
+	Code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.Code)
+}
+
+// retryable reports whether a download failure may go away on its own.
+func retryable(err error) bool {
+	var rejected *sourceRejectedError
+	if errors.As(err, &rejected) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests || statusErr.Code == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// openDownloads sets the directory partial downloads are kept in.
+func openDownloads(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create download dir %s: %v", dir, err)
+	}
+	downloadDir = dir
+	return nil
+}
+
+// partialDownloadPath names the partial download of url, below downloadDir or
+// else next to destDir. URLs are hashed rather than used as paths.
+func partialDownloadPath(url, destDir string) string {
+	dir := downloadDir
+	if dir == "" {
+		dir = filepath.Dir(destDir)
+	}
+	return filepath.Join(dir, cacheEntryID("url:"+url)+".download")
+}
+
+// lockDownload waits until no other job uses the partial download at path and
+// claims it. The returned function releases it.
+func lockDownload(ctx context.Context, path string) (unlock func(), err error) {
+	for {
+		downloadLocksMu.Lock()
+		held, busy := downloadLocks[path]
+		if !busy {
+			done := make(chan struct{})
+			downloadLocks[path] = done
+			downloadLocksMu.Unlock()
+			return func() {
+				downloadLocksMu.Lock()
+				delete(downloadLocks, path)
+				downloadLocksMu.Unlock()
+				close(done)
+			}, nil
+		}
+		downloadLocksMu.Unlock()
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// removePartialDownload deletes a partial download and its state file.
+func removePartialDownload(path string) {
+	os.Remove(path)
+	os.Remove(path + ".json")
+}
+
+// pruneDownloads removes partial downloads nobody has touched for
+// downloadRetention.
+func pruneDownloads(interval time.Duration) {
+	for range time.Tick(interval) {
+		files, err := filepath.Glob(filepath.Join(downloadDir, "*.download"))
+		if err != nil {
+			continue
+		}
+		for _, path := range files {
+			info, err := os.Stat(path)
+			if err != nil || time.Since(info.ModTime()) <= downloadRetention {
+				continue
+			}
+			downloadLocksMu.Lock()
+			_, busy := downloadLocks[path]
+			if !busy {
+				removePartialDownload(path)
+				fmt.Printf("[INFO] Removed stale partial download %s\n", filepath.Base(path))
+			}
+			downloadLocksMu.Unlock()
+		}
+	}
+}
+
+// downloadState is stored next to a partial download as <file>.json. A
+// download is only resumed from a file of the same URL whose validator (a
+// strong ETag or Last-Modified) the server still confirms with If-Range.
+type downloadState struct {
+	URL       string `json:"url"`
+	Validator string `json:"validator"`
+}
+
+// download is the state of a resumable download: how much of the file has
+// been written and hashed so far.
+type download struct {
+	url       string
+	path      string
+	file      *os.File
+	offset    int64
+	validator string
+	hasher    hash.Hash
+	progress  progressFunc
+}
+
+// downloadFile fetches url into path, resuming with HTTP Range requests after
+// failures and retrying with exponential backoff. A partial file left at path
+// by an earlier call is continued when its state file matches url. When
+// expectedSHA256 is set the finished file is checked against it.
+func downloadFile(ctx context.Context, url, path, expectedSHA256 string, progress progressFunc) error {
+	if _, err := http.NewRequest(http.MethodGet, url, nil); err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create download file: %v", err)
+	}
+	defer f.Close()
+
+	d := &download{url: url, path: path, file: f, hasher: sha256.New(), progress: progress}
+	if err := d.resume(); err != nil {
+		return fmt.Errorf("failed to resume download: %v", err)
+	}
+	backoff := downloadBackoff
+	for attempt := 0; ; attempt++ {
+		err := d.fetch(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryable(err) || attempt >= downloadRetries {
+			return fmt.Errorf("failed to download archive: %w", err)
+		}
+		fmt.Printf("[WARN] Download of %s failed at byte %d (%v); retrying in %s (%d/%d)\n",
+			sourceLabel(DataSourceRequest{Type: "archive_url", URL: url}), d.offset, err, backoff, attempt+1, downloadRetries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxDownloadBackoff)
+	}
+
+	if expectedSHA256 != "" {
+		actual := hex.EncodeToString(d.hasher.Sum(nil))
+		if !strings.EqualFold(actual, expectedSHA256) {
+			return &checksumMismatchError{Expected: strings.ToLower(expectedSHA256), Actual: actual}
+		}
+	}
+	return nil
+}
+
+// resume continues from what an earlier call left in the file, hashing it
+// again, or empties the file when it can't be trusted.
+func (d *download) resume() error {
+	var state downloadState
+	data, err := os.ReadFile(d.path + ".json")
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	info, statErr := d.file.Stat()
+	if err != nil || statErr != nil || state.URL != d.url || state.Validator == "" || info.Size() == 0 {
+		return d.restart()
+	}
+	if _, err := io.Copy(d.hasher, io.NewSectionReader(d.file, 0, info.Size())); err != nil {
+		return err
+	}
+	d.offset = info.Size()
+	d.validator = state.Validator
+	fmt.Printf("[INFO] Resuming download of %s at byte %d\n", sourceLabel(DataSourceRequest{Type: "archive_url", URL: d.url}), d.offset)
+	return nil
+}
+
+// saveState records the validator the file's content was fetched under.
+func (d *download) saveState() error {
+	data, err := json.Marshal(downloadState{URL: d.url, Validator: d.validator})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.path+".json", data, 0644)
+}
+
+// fetch runs one download attempt, continuing from d.offset when the server
+// honours the Range request and starting over when it doesn't.
+func (d *download) fetch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+	if d.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+		// If the file changed upstream, the server sends all of it instead.
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+	resp, err := sourceHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && d.offset > 0:
+		var start int64 = -1
+		fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+		if start != d.offset {
+			return fmt.Errorf("server resumed at byte %d instead of %d", start, d.offset)
+		}
+	case resp.StatusCode == http.StatusOK:
+		if d.offset > 0 {
+			fmt.Printf("[WARN] Server sent the whole file (changed upstream or no range support); restarting download from zero\n")
+		}
+		if err := d.restart(); err != nil {
+			return err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && d.offset > 0:
+		// The previous attempt already received everything.
+		return nil
+	default:
+		return &httpStatusError{Code: resp.StatusCode}
+	}
+	// A full response starts the file over under its own validator; a
+	// partial one continues under the validator the request carried.
+	if resp.StatusCode == http.StatusOK {
+		validator := resp.Header.Get("ETag")
+		if validator == "" || strings.HasPrefix(validator, "W/") {
+			validator = resp.Header.Get("Last-Modified")
+		}
+		d.validator = validator
+		if err := d.saveState(); err != nil {
+			return err
+		}
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = d.offset + resp.ContentLength
+	}
+	stall := time.AfterFunc(downloadStallTimeout, cancel)
+	defer stall.Stop()
+	body := &progressReader{r: &stallReader{r: resp.Body, timer: stall}, total: total, read: d.offset, progress: d.progress}
+
+	if _, err := d.file.Seek(d.offset, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(io.MultiWriter(d.file, d.hasher), body)
+	d.offset += n
+	if err != nil {
+		return err
+	}
+	if total >= 0 && d.offset != total {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (d *download) restart() error {
+	d.offset = 0
+	d.hasher.Reset()
+	return d.file.Truncate(0)
+}
+
+// stallReader pushes timer back on every read that returns data.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.timer.Reset(downloadStallTimeout)
+	}
+	return n, err
+}
+
+// verifyFileSHA256 checks a local archive against the expected checksum.
+func verifyFileSHA256(path, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return &checksumMismatchError{Expected: strings.ToLower(expected), Actual: actual}
+	}
+	return nil
+}
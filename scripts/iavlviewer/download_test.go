@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cutWriter aborts the response once limit bytes of the body were written,
+// like a dropped connection.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		w.ResponseWriter.Write(p[:w.limit])
+		panic(http.ErrAbortHandler)
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// snapshotServer serves one archive under an ETag, honouring Range and
+// If-Range, and can cut responses short.
+type snapshotServer struct {
+	mu       sync.Mutex
+	data     []byte
+	etag     string
+	cutAfter int
+	ranges   []string
+	ifRanges []string
+}
+
+func (s *snapshotServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data, etag, cutAfter := s.data, s.etag, s.cutAfter
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.ifRanges = append(s.ifRanges, r.Header.Get("If-Range"))
+	s.mu.Unlock()
+	w.Header().Set("ETag", etag)
+	if cutAfter > 0 {
+		w = &cutWriter{ResponseWriter: w, limit: cutAfter}
+	}
+	http.ServeContent(w, r, "snapshot.tar", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *snapshotServer) set(f func(s *snapshotServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func snapshotArchive(t *testing.T, content string) ([]byte, string) {
+	t.Helper()
+	data := buildTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "data/application.db/CURRENT"}, data: []byte(content)},
+		{hdr: tar.Header{Name: "data/application.db/000001.ldb"}, data: bytes.Repeat([]byte(content), 4096)},
+	}, false)
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:])
+}
+
+func TestDownloadResumesAcrossCalls(t *testing.T) {
+	saved, savedRetries := downloadDir, downloadRetries
+	downloadDir, downloadRetries = t.TempDir(), 0
+	t.Cleanup(func() { downloadDir, downloadRetries = saved, savedRetries })
+
+	data, sum := snapshotArchive(t, "MANIFEST-000001\n")
+	s := &snapshotServer{data: data, etag: `"v1"`, cutAfter: len(data) / 2}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := srv.URL + "/snapshot.tar"
+	partial := partialDownloadPath(url, "")
+
+	extract := func(sha string) (string, error) {
+		dest := filepath.Join(t.TempDir(), "dir1")
+		return dest, downloadAndExtractArchive(context.Background(), url, sha, dest, nil)
+	}
+	readCurrent := func(dest string) string {
+		t.Helper()
+		b, err := os.ReadFile(filepath.Join(dest, "data", "application.db", "CURRENT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// The first call runs out of retries and leaves the partial file behind.
+	if _, err := extract(sum); err == nil {
+		t.Fatal("cut download succeeded")
+	}
+	info, err := os.Stat(partial)
+	if err != nil || info.Size() == 0 || info.Size() >= int64(len(data)) {
+		t.Fatalf("partial download: %v, %v", info, err)
+	}
+
+	// The next call continues it.
+	s.set(func(s *snapshotServer) { s.cutAfter = 0 })
+	dest, err := extract(sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readCurrent(dest); got != "MANIFEST-000001\n" {
+		t.Errorf("CURRENT = %q", got)
+	}
+	last := len(s.ranges) - 1
+	if want := "bytes=" + strconv.FormatInt(info.Size(), 10) + "-"; s.ranges[last] != want || s.ifRanges[last] != `"v1"` {
+		t.Errorf("resumed with Range %q If-Range %q, want %q %q", s.ranges[last], s.ifRanges[last], want, `"v1"`)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial download kept after a successful extract: %v", err)
+	}
+
+	// A partial file of an archive that changed upstream is started over.
+	s.set(func(s *snapshotServer) { s.cutAfter = len(data) / 2 })
+	if _, err := extract(""); err == nil {
+		t.Fatal("cut download succeeded")
+	}
+	data2, sum2 := snapshotArchive(t, "MANIFEST-000002\n")
+	s.set(func(s *snapshotServer) { s.data, s.etag, s.cutAfter = data2, `"v2"`, 0 })
+	dest, err = extract(sum2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readCurrent(dest); got != "MANIFEST-000002\n" {
+		t.Errorf("CURRENT = %q after the archive changed", got)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Heimdall, the consensus layer of Polygon PoS, keys its stores with
+// Ethereum addresses and decimal numbers and stores amino-encoded values.
+func init() {
+	registerKeyDecoder(chainHeimdall, "checkpoint", &moduleKeys{module: "checkpoint", prefixes: map[byte]keyPrefix{
+		0x11: {"ack_count", nil},
+		0x12: {"buffered_checkpoint", nil},
+		0x13: {"checkpoint", func(r *keyReader) { r.str("number") }},
+		0x14: {"last_no_ack", nil},
+	}})
+
+	registerKeyDecoder(chainHeimdall, "staking", &moduleKeys{module: "staking", prefixes: map[byte]keyPrefix{
+		0x21: {"validator", func(r *keyReader) { r.fixedAddress("signer", addrEthereum, 20) }},
+		0x22: {"validator_id", func(r *keyReader) { r.str("id") }},
+		0x23: {"current_validator_set", nil},
+		0x24: {"staking_sequence", func(r *keyReader) { r.str("sequence") }},
+	}})
+
+	registerKeyDecoder(chainHeimdall, "bor", &moduleKeys{module: "bor", prefixes: map[byte]keyPrefix{
+		0x35: {"last_span_id", nil},
+		0x36: {"span", func(r *keyReader) { r.str("id") }},
+		0x38: {"last_processed_eth_block", nil},
+	}})
+
+	registerKeyDecoder(chainHeimdall, "clerk", &moduleKeys{module: "clerk", prefixes: map[byte]keyPrefix{
+		0x11: {"event_record", func(r *keyReader) { r.str("id") }},
+		0x12: {"record_sequence", func(r *keyReader) { r.str("sequence") }},
+		// The time index ends with the record's own key, prefix included.
+		0x13: {"event_record_by_time", func(r *keyReader) { r.time("record_time"); r.prefixByte(0x11); r.str("id") }},
+	}})
+
+	registerKeyDecoder(chainHeimdall, "topup", &moduleKeys{module: "topup", prefixes: map[byte]keyPrefix{
+		0x81: {"topup_sequence", func(r *keyReader) { r.str("sequence") }},
+		0x82: {"dividend_account", func(r *keyReader) { r.fixedAddress("user", addrEthereum, 20) }},
+	}})
+}
+
+// aminoKind is how a field of an amino struct is encoded and rendered.
+type aminoKind int
+
+const (
+	aminoUint aminoKind = iota
+	aminoInt
+	aminoBool
+	aminoString
+	aminoAddress
+	aminoHash
+	aminoBytes
+	aminoTime
+	aminoStruct
+)
+
+// aminoField is a field of an amino-encoded struct. Amino numbers the fields
+// of a Go struct from 1 in declaration order, so a layout lists them in that
+// order, named after the struct's JSON tags.
+type aminoField struct {
+	name     string
+	kind     aminoKind
+	repeated bool
+	fields   []aminoField
+}
+
+var (
+	heimdallValidator = []aminoField{
+		{name: "ID", kind: aminoUint},
+		{name: "startEpoch", kind: aminoUint},
+		{name: "endEpoch", kind: aminoUint},
+		{name: "nonce", kind: aminoUint},
+		{name: "power", kind: aminoInt},
+		{name: "pubKey", kind: aminoBytes},
+		{name: "signer", kind: aminoAddress},
+		{name: "last_updated", kind: aminoString},
+		{name: "jailed", kind: aminoBool},
+		{name: "accum", kind: aminoInt},
+	}
+	heimdallValidatorSet = []aminoField{
+		{name: "validators", kind: aminoStruct, repeated: true, fields: heimdallValidator},
+		{name: "proposer", kind: aminoStruct, fields: heimdallValidator},
+	}
+	heimdallCheckpoint = []aminoField{
+		{name: "proposer", kind: aminoAddress},
+		{name: "start_block", kind: aminoUint},
+		{name: "end_block", kind: aminoUint},
+		{name: "root_hash", kind: aminoHash},
+		{name: "bor_chain_id", kind: aminoString},
+		{name: "timestamp", kind: aminoUint},
+	}
+	heimdallSpan = []aminoField{
+		{name: "span_id", kind: aminoUint},
+		{name: "start_block", kind: aminoUint},
+		{name: "end_block", kind: aminoUint},
+		{name: "validator_set", kind: aminoStruct, fields: heimdallValidatorSet},
+		{name: "selected_producers", kind: aminoStruct, repeated: true, fields: heimdallValidator},
+		{name: "bor_chain_id", kind: aminoString},
+	}
+	heimdallEventRecord = []aminoField{
+		{name: "id", kind: aminoUint},
+		{name: "contract", kind: aminoAddress},
+		{name: "data", kind: aminoBytes},
+		{name: "tx_hash", kind: aminoHash},
+		{name: "log_index", kind: aminoUint},
+		{name: "bor_chain_id", kind: aminoString},
+		{name: "record_time", kind: aminoTime},
+	}
+	heimdallDividendAccount = []aminoField{
+		{name: "user", kind: aminoAddress},
+		{name: "feeAmount", kind: aminoString},
+	}
+)
+
+// heimdallValue is how the values under a Heimdall key prefix are stored:
+// as an amino struct, a bare amino uint64, or a decimal number or raw
+// address. label names a
+// number or address in descriptions when the key doesn't already.
+type heimdallValue struct {
+	typeName string
+	fields   []aminoField
+	label    string
+}
+
+const (
+	heimdallDecimal = "decimal"
+	heimdallAddress = "address"
+	heimdallUint64  = "uint64"
+)
+
+// heimdallValues maps store and decoded key prefix to the layout of the
+// values there. Sequence keys only mark a processed event and aren't listed.
+var heimdallValues = map[string]map[string]heimdallValue{
+	"checkpoint": {
+		"ack_count":           {typeName: heimdallDecimal},
+		"buffered_checkpoint": {typeName: "Checkpoint", fields: heimdallCheckpoint},
+		"checkpoint":          {typeName: "Checkpoint", fields: heimdallCheckpoint},
+		"last_no_ack":         {typeName: heimdallDecimal},
+	},
+	"staking": {
+		"validator":             {typeName: "Validator", fields: heimdallValidator},
+		"validator_id":          {typeName: heimdallAddress, label: "signer"},
+		"current_validator_set": {typeName: "ValidatorSet", fields: heimdallValidatorSet},
+	},
+	"bor": {
+		"last_span_id":             {typeName: heimdallDecimal},
+		"span":                     {typeName: "Span", fields: heimdallSpan},
+		"last_processed_eth_block": {typeName: heimdallDecimal},
+	},
+	"clerk": {
+		"event_record":         {typeName: "EventRecord", fields: heimdallEventRecord},
+		"event_record_by_time": {typeName: heimdallUint64, label: "record id"},
+	},
+	"topup": {
+		"dividend_account": {typeName: "DividendAccount", fields: heimdallDividendAccount},
+	},
+}
+
+// isHeimdallStores reports whether a commit's stores are those of a Heimdall
+// node, which has checkpoint and bor stores no SDK chain has.
+func isHeimdallStores(names map[string]bool) bool {
+	return names["checkpoint"] && names["bor"]
+}
+
+// decodeHeimdallValues decodes the values of a Heimdall store difference. It
+// reports false when the key's values have no known layout.
+func decodeHeimdallValues(storeName string, diff *StoreDifference) bool {
+	if diff.DecodedKey == nil {
+		return false
+	}
+	layout, ok := heimdallValues[storeName][diff.DecodedKey.Prefix]
+	if !ok {
+		return false
+	}
+	diff.ValueType = "heimdall." + layout.typeName
+	if layout.fields == nil {
+		diff.ValueType = layout.typeName
+	}
+	var errs []string
+	decodeSide := func(valueHex, side string) json.RawMessage {
+		value, _ := hex.DecodeString(valueHex)
+		decoded, err := layout.decode(value)
+		if err != nil {
+			errs = append(errs, side+": "+err.Error())
+		}
+		return decoded
+	}
+	if diff.Type != "key_only_source2" {
+		diff.Value1Decoded = decodeSide(diff.Value1Hex, "value1")
+	}
+	if diff.Type != "key_only_source1" {
+		diff.Value2Decoded = decodeSide(diff.Value2Hex, "value2")
+	}
+	diff.DecodeError = strings.Join(errs, "; ")
+	if diff.Value1Decoded != nil && diff.Value2Decoded != nil {
+		diff.FieldChanges = diffJSON(diff.Value1Decoded, diff.Value2Decoded)
+	}
+	return true
+}
+
+func (v heimdallValue) decode(value []byte) (json.RawMessage, error) {
+	switch v.typeName {
+	case heimdallDecimal:
+		// Block numbers are big.Int strings, which may not fit a uint64.
+		if len(value) == 0 || strings.Trim(string(value), "0123456789") != "" {
+			return nil, fmt.Errorf("not a decimal number")
+		}
+		return json.Marshal(string(value))
+	case heimdallAddress:
+		if len(value) != 20 {
+			return nil, fmt.Errorf("not an address")
+		}
+		return json.Marshal("0x" + hex.EncodeToString(value))
+	case heimdallUint64:
+		n, l := protowire.ConsumeVarint(value)
+		if l != len(value) {
+			return nil, fmt.Errorf("not an amino uint64")
+		}
+		return json.Marshal(strconv.FormatUint(n, 10))
+	}
+	var buf bytes.Buffer
+	err := decodeAminoStruct(&buf, v.fields, value)
+	if err != nil {
+		// Some values are written with MarshalBinaryLengthPrefixed.
+		if n, l := protowire.ConsumeVarint(value); l > 0 && n == uint64(len(value)-l) {
+			buf.Reset()
+			if decodeAminoStruct(&buf, v.fields, value[l:]) == nil {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("not a valid %s: %v", v.typeName, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeAminoStruct renders the amino encoding of a struct as a JSON object
+// with its fields in declaration order. Fields amino left out because they
+// hold their zero value are rendered with it, so a change from zero shows up
+// in the field diff. 64-bit integers are strings, as in amino JSON.
+func decodeAminoStruct(buf *bytes.Buffer, fields []aminoField, data []byte) error {
+	values := make([][]json.RawMessage, len(fields))
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if int(num) > len(fields) {
+			return fmt.Errorf("unknown field %d", num)
+		}
+		field := fields[num-1]
+		value, n, err := decodeAminoField(field, typ, data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field.name, err)
+		}
+		data = data[n:]
+		if field.repeated {
+			values[num-1] = append(values[num-1], value)
+		} else {
+			values[num-1] = []json.RawMessage{value}
+		}
+	}
+
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(field.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		switch {
+		case field.repeated:
+			buf.WriteByte('[')
+			for j, v := range values[i] {
+				if j > 0 {
+					buf.WriteByte(',')
+				}
+				buf.Write(v)
+			}
+			buf.WriteByte(']')
+		case values[i] != nil:
+			buf.Write(values[i][0])
+		default:
+			buf.Write(aminoZeroValue(field.kind))
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// decodeAminoField decodes one field value from the start of data, returning
+// it as JSON with the number of bytes consumed.
+func decodeAminoField(field aminoField, typ protowire.Type, data []byte) (json.RawMessage, int, error) {
+	switch field.kind {
+	case aminoUint, aminoInt, aminoBool:
+		if typ != protowire.VarintType {
+			return nil, 0, fmt.Errorf("unexpected wire type %d", typ)
+		}
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		switch field.kind {
+		case aminoBool:
+			return json.RawMessage(strconv.FormatBool(v != 0)), n, nil
+		case aminoInt:
+			return json.RawMessage(strconv.Quote(strconv.FormatInt(int64(v), 10))), n, nil
+		}
+		return json.RawMessage(strconv.Quote(strconv.FormatUint(v, 10))), n, nil
+	}
+
+	if typ != protowire.BytesType {
+		return nil, 0, fmt.Errorf("unexpected wire type %d", typ)
+	}
+	b, n := protowire.ConsumeBytes(data)
+	if n < 0 {
+		return nil, 0, protowire.ParseError(n)
+	}
+	var out []byte
+	var err error
+	switch field.kind {
+	case aminoString:
+		out, err = json.Marshal(string(b))
+	case aminoAddress, aminoHash, aminoBytes:
+		out, err = json.Marshal("0x" + hex.EncodeToString(b))
+	case aminoTime:
+		var t time.Time
+		t, err = decodeAminoTime(b)
+		if err == nil {
+			out, err = json.Marshal(t.UTC().Format(time.RFC3339Nano))
+		}
+	case aminoStruct:
+		var buf bytes.Buffer
+		err = decodeAminoStruct(&buf, field.fields, b)
+		out = buf.Bytes()
+	}
+	return out, n, err
+}
+
+// decodeAminoTime decodes amino's encoding of time.Time, a struct of seconds
+// and nanoseconds since the Unix epoch.
+func decodeAminoTime(data []byte) (time.Time, error) {
+	var seconds, nanos uint64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.VarintType || num > 2 {
+			return time.Time{}, fmt.Errorf("invalid time")
+		}
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num == 1 {
+			seconds = v
+		} else {
+			nanos = v
+		}
+	}
+	return time.Unix(int64(seconds), int64(nanos)), nil
+}
+
+func aminoZeroValue(kind aminoKind) json.RawMessage {
+	switch kind {
+	case aminoUint, aminoInt:
+		return json.RawMessage(`"0"`)
+	case aminoBool:
+		return json.RawMessage(`false`)
+	case aminoString:
+		return json.RawMessage(`""`)
+	case aminoAddress:
+		return json.RawMessage(`"0x` + strings.Repeat("00", 20) + `"`)
+	case aminoHash:
+		return json.RawMessage(`"0x` + strings.Repeat("00", 32) + `"`)
+	case aminoBytes:
+		return json.RawMessage(`"0x"`)
+	}
+	return json.RawMessage(`null`)
+}
+
+// describeHeimdallDifference words a difference by what it is about, e.g.
+// "validator 0x6ab3… signer/power differ" or "checkpoint 1234 root hash
+// differs", from the decoded key and the changed top-level fields.
+func describeHeimdallDifference(storeName string, diff *StoreDifference) {
+	if diff.DecodedKey == nil {
+		return
+	}
+	subject := []string{humanizeFieldName(diff.DecodedKey.Prefix)}
+	for _, f := range diff.DecodedKey.Fields {
+		subject = append(subject, f.Value)
+	}
+	switch diff.Type {
+	case "key_only_source1", "key_only_source2":
+		diff.Description = fmt.Sprintf("%s exists only in %s", strings.Join(subject, " "), strings.TrimPrefix(diff.Type, "key_only_"))
+		return
+	}
+	if len(diff.FieldChanges) == 0 {
+		return
+	}
+	var changed []string
+	seen := map[string]bool{}
+	for _, c := range diff.FieldChanges {
+		if c.Path == "" {
+			if label := heimdallValues[storeName][diff.DecodedKey.Prefix].label; label != "" {
+				changed = append(changed, label)
+			}
+			break
+		}
+		field, _, _ := strings.Cut(c.Path, ".")
+		if !seen[field] {
+			seen[field] = true
+			changed = append(changed, humanizeFieldName(field))
+		}
+	}
+	verb := "differs"
+	if len(changed) > 1 {
+		verb = "differ"
+	}
+	if len(changed) > 0 {
+		subject = append(subject, strings.Join(changed, "/"))
+	}
+	diff.Description = strings.Join(subject, " ") + " " + verb
+}
+
+// humanizeFieldName turns "root_hash" or "startEpoch" into "root hash" or
+// "start epoch".
+func humanizeFieldName(name string) string {
+	var sb strings.Builder
+	runes := []rune(name)
+	for i, c := range runes {
+		switch {
+		case c == '_':
+			sb.WriteByte(' ')
+		case unicode.IsUpper(c):
+			if i > 0 && unicode.IsLower(runes[i-1]) {
+				sb.WriteByte(' ')
+			}
+			sb.WriteRune(unicode.ToLower(c))
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The values below are laid out as go-amino's MarshalBinaryBare writes
+// Heimdall's types: struct fields numbered in declaration order, zero values
+// left out, byte arrays as length-delimited bytes.
+const (
+	// Validator{ID: 5, Nonce: 3, VotingPower: 10, PubKey: 0x0401..40,
+	// Signer: 0x6ab3..63, LastUpdated: "1000"}
+	heimdallValidator1Hex = "08052003280a3241040102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f403a146ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263420431303030"
+	// The same validator with VotingPower 12 and Jailed set.
+	heimdallValidator2Hex = "08052003280c3241040102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f403a146ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a1908172634204313030304801"
+	// Checkpoint{Proposer: 0xaa..aa, StartBlock: 100, EndBlock: 355,
+	// RootHash: 0xd2f4 11.., BorChainID: "137", TimeStamp: 1700000000}
+	heimdallCheckpoint1Hex = "0a14aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa106418e3022220d2f41111111111111111111111111111111111111111111111111111111111112a033133373080e2cfaa06"
+	// The same checkpoint with RootHash 0xd2f5 11...
+	heimdallCheckpoint2Hex = "0a14aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa106418e3022220d2f51111111111111111111111111111111111111111111111111111111111112a033133373080e2cfaa06"
+	// EventRecord{ID: 42, Contract: 0xcc..cc, Data: 0x0102, LogIndex: 3,
+	// ChainID: "137", RecordTime: 2023-11-14T22:13:20Z}
+	heimdallEventRecord1Hex = "082a1214cccccccccccccccccccccccccccccccccccccccc1a02010222200000000000000000000000000000000000000000000000000000000000000000280332033133373a060880e2cfaa06"
+	// The same record 5ns later.
+	heimdallEventRecord2Hex = "082a1214cccccccccccccccccccccccccccccccccccccccc1a02010222200000000000000000000000000000000000000000000000000000000000000000280332033133373a080880e2cfaa061005"
+)
+
+func TestDecodeHeimdallDifferences(t *testing.T) {
+	// Span 7 with the first validator as the whole set, proposer and
+	// producer, written with MarshalBinaryLengthPrefixed.
+	validatorLen := hex.EncodeToString([]byte{byte(len(heimdallValidator1Hex) / 2)})
+	set := "0a" + validatorLen + heimdallValidator1Hex + "12" + validatorLen + heimdallValidator1Hex
+	span := "080710e80718e73922ce01" + set + "2a" + validatorLen + heimdallValidator1Hex + "3203313337"
+	spanHex := "c502" + span
+
+	tests := []struct {
+		name        string
+		store       string
+		diff        StoreDifference
+		prefix      string
+		keyFields   string
+		valueType   string
+		changes     []string
+		description string
+	}{
+		{
+			name:  "checkpoint root hash",
+			store: "checkpoint",
+			diff: StoreDifference{Type: "value_differ", KeyHex: "13" + hex.EncodeToString([]byte("1234")),
+				Value1Hex: heimdallCheckpoint1Hex, Value2Hex: heimdallCheckpoint2Hex},
+			prefix:      "checkpoint",
+			keyFields:   "number=1234",
+			valueType:   "heimdall.Checkpoint",
+			changes:     []string{"root_hash: 0xd2f4" + strings.Repeat("11", 30) + " -> 0xd2f5" + strings.Repeat("11", 30)},
+			description: "checkpoint 1234 root hash differs",
+		},
+		{
+			name:  "validator power and jailed",
+			store: "staking",
+			diff: StoreDifference{Type: "value_differ", KeyHex: "216ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263",
+				Value1Hex: heimdallValidator1Hex, Value2Hex: heimdallValidator2Hex},
+			prefix:      "validator",
+			keyFields:   "signer=0x6ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263",
+			valueType:   "heimdall.Validator",
+			changes:     []string{"jailed: false -> true", "power: 10 -> 12"},
+			description: "validator 0x6ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263 jailed/power differ",
+		},
+		{
+			name:  "validator id mapping",
+			store: "staking",
+			diff: StoreDifference{Type: "value_differ", KeyHex: "2235",
+				Value1Hex: "6ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263", Value2Hex: "1111111111111111111111111111111111111111"},
+			prefix:      "validator_id",
+			keyFields:   "id=5",
+			valueType:   heimdallAddress,
+			changes:     []string{"(value): 0x6ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263 -> 0x1111111111111111111111111111111111111111"},
+			description: "validator id 5 signer differs",
+		},
+		{
+			name:  "length-prefixed span",
+			store: "bor",
+			diff: StoreDifference{Type: "key_only_source1", KeyHex: "36" + hex.EncodeToString([]byte("7")),
+				Value1Hex: spanHex},
+			prefix:      "span",
+			keyFields:   "id=7",
+			valueType:   "heimdall.Span",
+			description: "span 7 exists only in source1",
+		},
+		{
+			name:  "event record time",
+			store: "clerk",
+			diff: StoreDifference{Type: "value_differ", KeyHex: "11" + hex.EncodeToString([]byte("42")),
+				Value1Hex: heimdallEventRecord1Hex, Value2Hex: heimdallEventRecord2Hex},
+			prefix:      "event_record",
+			keyFields:   "id=42",
+			valueType:   "heimdall.EventRecord",
+			changes:     []string{"record_time: 2023-11-14T22:13:20Z -> 2023-11-14T22:13:20.000000005Z"},
+			description: "event record 42 record time differs",
+		},
+		{
+			name:  "event record time index",
+			store: "clerk",
+			diff: StoreDifference{Type: "value_differ",
+				KeyHex:    "13" + hex.EncodeToString([]byte("2023-11-14T22:13:20.000000000")) + "11" + hex.EncodeToString([]byte("42")),
+				Value1Hex: "2a", Value2Hex: "2b"},
+			prefix:      "event_record_by_time",
+			keyFields:   "record_time=2023-11-14T22:13:20Z id=42",
+			valueType:   heimdallUint64,
+			changes:     []string{"(value): 42 -> 43"},
+			description: "event record by time 2023-11-14T22:13:20Z 42 record id differs",
+		},
+		{
+			name:  "ack count",
+			store: "checkpoint",
+			diff: StoreDifference{Type: "value_differ", KeyHex: "11",
+				Value1Hex: hex.EncodeToString([]byte("1234")), Value2Hex: hex.EncodeToString([]byte("1235"))},
+			prefix:      "ack_count",
+			valueType:   heimdallDecimal,
+			changes:     []string{"(value): 1234 -> 1235"},
+			description: "ack count differs",
+		},
+	}
+
+	d := &differenceDecoder{chain: chainHeimdall}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := []StoreDifference{tt.diff}
+			d.decode(context.Background(), tt.store, diffs)
+			diff := diffs[0]
+			if diff.DecodeError != "" {
+				t.Fatalf("decode error: %s", diff.DecodeError)
+			}
+			if diff.DecodedKey == nil || diff.DecodedKey.Prefix != tt.prefix {
+				t.Fatalf("decoded key = %v, want prefix %s", diff.DecodedKey, tt.prefix)
+			}
+			var fields []string
+			for _, f := range diff.DecodedKey.Fields {
+				fields = append(fields, f.Name+"="+f.Value)
+			}
+			if got := strings.Join(fields, " "); got != tt.keyFields {
+				t.Errorf("key fields = %q, want %q", got, tt.keyFields)
+			}
+			if diff.ValueType != tt.valueType {
+				t.Errorf("value type = %q, want %q", diff.ValueType, tt.valueType)
+			}
+			var changes []string
+			for _, c := range diff.FieldChanges {
+				changes = append(changes, c.String())
+			}
+			if strings.Join(changes, "\n") != strings.Join(tt.changes, "\n") {
+				t.Errorf("field changes = %q, want %q", changes, tt.changes)
+			}
+			if diff.Description != tt.description {
+				t.Errorf("description = %q, want %q", diff.Description, tt.description)
+			}
+		})
+	}
+}
+
+func TestHeimdallValidatorValue(t *testing.T) {
+	value, _ := hex.DecodeString(heimdallValidator1Hex)
+	decoded, err := heimdallValues["staking"]["validator"].decode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ID":"5","startEpoch":"0","endEpoch":"0","nonce":"3","power":"10",` +
+		`"pubKey":"0x040102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40",` +
+		`"signer":"0x6ab3c5a1f2e4d0b9c8a7f6e5d4c3b2a190817263","last_updated":"1000","jailed":false,"accum":"0"}`
+	if string(decoded) != want {
+		t.Errorf("decoded = %s\nwant %s", decoded, want)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 500
+)
+
+// History layout in the embedded DB:
+//
+//	c/<id>                   -> JSON comparisonRecord
+//	t/<unix nanos BE8>/<id>  -> empty, orders records by creation time
+var (
+	historyRecordPrefix = []byte("c/")
+	historyTimePrefix   = []byte("t/")
+)
+
+// historyDB holds finished comparison reports. It is nil in CLI mode, where
+// nothing is persisted.
+var historyDB dbm.DB
+
+type comparisonRecord struct {
+	ID        string          `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Source1   string          `json:"source1"`
+	Source2   string          `json:"source2"`
+	Response  CompareResponse `json:"response"`
+	// Owner is the client that ran the comparison; see requestOwner.
+	Owner string `json:"owner,omitempty"`
+}
+
+// ComparisonListEntry is the summary of a stored comparison returned by
+// GET /comparisons; the full report lives under GET /comparisons/{id}.
+type ComparisonListEntry struct {
+	ID             string            `json:"id"`
+	CreatedAt      string            `json:"created_at"`
+	Source1        string            `json:"source1"`
+	Source2        string            `json:"source2"`
+	Source1Version int64             `json:"source1_version"`
+	Source2Version int64             `json:"source2_version"`
+	IsIdentical    bool              `json:"is_identical"`
+	Summary        ComparisonSummary `json:"summary"`
+}
+
+type ComparisonList struct {
+	Success     bool                  `json:"success"`
+	Error       string                `json:"error,omitempty"`
+	Comparisons []ComparisonListEntry `json:"comparisons"`
+	// NextCursor is the ID of the last entry on this page; pass it back as
+	// ?cursor= to continue. It is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// openHistory opens (or creates) the comparison history under dataDir.
+func openHistory(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data dir %s: %v", dataDir, err)
+	}
+	db, err := dbm.NewDB("history", dbm.GoLevelDBBackend, dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to open comparison history in %s: %v", dataDir, err)
+	}
+	historyDB = db
+	return nil
+}
+
+// saveComparison stores a successful response under id and records the id in
+// its metadata. Failures to persist are logged but don't fail the comparison.
+func saveComparison(id string, req CompareRequest, response *CompareResponse) {
+	if historyDB == nil {
+		return
+	}
+	response.Metadata.ComparisonID = id
+	rec := comparisonRecord{
+		ID:        id,
+		CreatedAt: time.Now().UTC(),
+		Source1:   sourceLabel(req.Source1),
+		Source2:   sourceLabel(req.Source2),
+		Response:  *response,
+		Owner:     req.Owner,
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Printf("[WARN] Failed to encode comparison %s for history: %v\n", id, err)
+		return
+	}
+	batch := historyDB.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(historyRecordKey(id), data); err != nil {
+		fmt.Printf("[WARN] Failed to save comparison %s: %v\n", id, err)
+		return
+	}
+	if err := batch.Set(historyTimeKey(rec.CreatedAt, id), []byte{}); err != nil {
+		fmt.Printf("[WARN] Failed to save comparison %s: %v\n", id, err)
+		return
+	}
+	if err := batch.WriteSync(); err != nil {
+		fmt.Printf("[WARN] Failed to save comparison %s: %v\n", id, err)
+	}
+}
+
+func loadComparison(id string) (*comparisonRecord, error) {
+	data, err := historyDB.Get(historyRecordKey(id))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var rec comparisonRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("corrupt history record %s: %v", id, err)
+	}
+	return &rec, nil
+}
+
+func historyRecordKey(id string) []byte {
+	return append(append([]byte{}, historyRecordPrefix...), id...)
+}
+
+func historyTimeKey(t time.Time, id string) []byte {
+	key := append([]byte{}, historyTimePrefix...)
+	key = binary.BigEndian.AppendUint64(key, uint64(t.UnixNano()))
+	key = append(key, '/')
+	return append(key, id...)
+}
+
+// sourceLabel names a source for listings and filters: its path, its URL
+// without credentials or query string, or the uploaded file name.
+func sourceLabel(req DataSourceRequest) string {
+	switch req.Type {
+	case "archive_url", "zip_url":
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return req.URL
+		}
+		u.User, u.RawQuery, u.Fragment = nil, "", ""
+		return u.String()
+	case "upload":
+		if req.Name == "" && req.UploadID != "" {
+			if u := lookupUpload(req.UploadID); u != nil {
+				return u.snapshot().Name
+			}
+			return req.UploadID
+		}
+		return req.Name
+	default:
+		return req.Path
+	}
+}
+
+// historyFilter holds the GET /comparisons query parameters.
+type historyFilter struct {
+	from, to  time.Time
+	identical *bool
+	source    string
+	// owner is not a query parameter: clients only see their own
+	// comparisons.
+	owner string
+}
+
+func (f historyFilter) matches(rec *comparisonRecord) bool {
+	if rec.Owner != f.owner {
+		return false
+	}
+	if f.identical != nil && rec.Response.Summary.IsIdentical != *f.identical {
+		return false
+	}
+	if f.source != "" && !strings.Contains(rec.Source1, f.source) && !strings.Contains(rec.Source2, f.source) {
+		return false
+	}
+	return true
+}
+
+// parseHistoryTime accepts RFC 3339 timestamps or plain dates. A plain date
+// used as an upper bound covers the whole day.
+func parseHistoryTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use YYYY-MM-DD or RFC 3339", s)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// listComparisons returns up to limit records matching f, newest first,
+// starting after the record with ID cursor.
+func listComparisons(f historyFilter, cursor string, limit int) ([]*comparisonRecord, bool, error) {
+	start := append([]byte{}, historyTimePrefix...)
+	if !f.from.IsZero() {
+		start = historyTimeKey(f.from, "")
+	}
+	end := []byte("t0") // first key past the "t/" prefix
+	if !f.to.IsZero() {
+		end = historyTimeKey(f.to.Add(time.Nanosecond), "")
+	}
+	if cursor != "" {
+		rec, err := loadComparison(cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		if rec == nil || rec.Owner != f.owner {
+			return nil, false, fmt.Errorf("unknown cursor %q", cursor)
+		}
+		// Iterator ends are exclusive, so this resumes right after the cursor.
+		if key := historyTimeKey(rec.CreatedAt, cursor); string(key) < string(end) {
+			end = key
+		}
+	}
+
+	iter, err := historyDB.ReverseIterator(start, end)
+	if err != nil {
+		return nil, false, err
+	}
+	defer iter.Close()
+
+	var records []*comparisonRecord
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		id := string(key[len(historyTimePrefix)+9:])
+		rec, err := loadComparison(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if rec == nil || !f.matches(rec) {
+			continue
+		}
+		if len(records) == limit {
+			return records, true, nil
+		}
+		records = append(records, rec)
+	}
+	return records, false, iter.Error()
+}
+
+// handleComparisonsAPI lists stored comparisons.
+func handleComparisonsAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[History] %s %s from %s\n", r.Method, r.URL.String(), r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	list := ComparisonList{Comparisons: []ComparisonListEntry{}}
+	fail := func(status int, msg string) {
+		list.Error = msg
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(list)
+	}
+
+	if r.Method != http.MethodGet {
+		fail(http.StatusMethodNotAllowed, "Method not allowed. Use GET.")
+		return
+	}
+
+	q := r.URL.Query()
+	var f historyFilter
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.from, err = parseHistoryTime(v, false); err != nil {
+			fail(http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.to, err = parseHistoryTime(v, true); err != nil {
+			fail(http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+	}
+	if v := q.Get("identical"); v != "" {
+		identical, err := strconv.ParseBool(v)
+		if err != nil {
+			fail(http.StatusBadRequest, "identical must be true or false")
+			return
+		}
+		f.identical = &identical
+	}
+	f.source = q.Get("source")
+	f.owner = requestOwner(r)
+	limit := defaultHistoryPageSize
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			fail(http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxHistoryPageSize)
+	}
+
+	records, hasMore, err := listComparisons(f, q.Get("cursor"), limit)
+	if err != nil {
+		fail(http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, rec := range records {
+		list.Comparisons = append(list.Comparisons, ComparisonListEntry{
+			ID:             rec.ID,
+			CreatedAt:      rec.CreatedAt.Format(time.RFC3339),
+			Source1:        rec.Source1,
+			Source2:        rec.Source2,
+			Source1Version: rec.Response.Metadata.Source1Version,
+			Source2Version: rec.Response.Metadata.Source2Version,
+			IsIdentical:    rec.Response.Summary.IsIdentical,
+			Summary:        rec.Response.Summary,
+		})
+	}
+	list.Success = true
+	list.HasMore = hasMore
+	if hasMore {
+		list.NextCursor = records[len(records)-1].ID
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleComparisonAPI returns a stored comparison report as it was sent.
+func handleComparisonAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[History] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   "Method not allowed. Use GET.",
+		})
+		return
+	}
+
+	rec, err := loadComparison(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if rec == nil || rec.Owner != requestOwner(r) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   "Comparison not found",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(rec.Response)
+}
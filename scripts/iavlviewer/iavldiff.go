@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// iavlNode is an IAVL node decoded straight from the store's DB. Keeping our
+// own reader lets the diff engine see child pointers and subtree hashes, which
+// the iavl package keeps private.
+type iavlNode struct {
+	height int8
+	key    []byte
+	value  []byte
+	// hash is stored for inner nodes and, for legacy nodes, doubles as the DB
+	// key. It is nil for new-format leaves, which are compared by key/value.
+	hash  []byte
+	left  []byte
+	right []byte
+}
+
+func (n *iavlNode) isLeaf() bool {
+	return n.height == 0
+}
+
+// iavlNodeReader reads the nodes of one store's IAVL tree from an application
+// DB, following the on-disk layout of github.com/cosmos/iavl v1: new nodes
+// under 's'<version><nonce> and pre-v1 nodes under 'n'<hash>.
+type iavlNodeReader struct {
+	db    dbm.DB
+	reads int
+}
+
+func newIAVLNodeReader(appDB dbm.DB, storeName string) *iavlNodeReader {
+	return &iavlNodeReader{db: dbm.NewPrefixDB(appDB, []byte("s/k:"+storeName+"/"))}
+}
+
+// root returns the root node of the tree at version, or nil for an empty tree.
+func (r *iavlNodeReader) root(version int64) (*iavlNode, error) {
+	rootKey := iavlNodeKey(version, 1)
+	val, err := r.db.Get(append([]byte{'s'}, rootKey...))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		legacyKey := make([]byte, 9)
+		legacyKey[0] = 'r'
+		binary.BigEndian.PutUint64(legacyKey[1:], uint64(version))
+		val, err = r.db.Get(legacyKey)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			return nil, fmt.Errorf("IAVL version %d does not exist", version)
+		}
+		if len(val) == 0 {
+			return nil, nil
+		}
+		return r.node(val)
+	}
+	if len(val) == 0 {
+		return nil, nil
+	}
+	if val[0] == 's' {
+		// A version without changes stores a reference to an earlier root.
+		switch len(val) {
+		case 13:
+			ref := val[1:]
+			node, err := r.node(ref)
+			if err == nil {
+				return node, nil
+			}
+			// Pruning may have rewritten the referenced root with nonce 0.
+			return r.node(iavlNodeKey(int64(binary.BigEndian.Uint64(ref)), 0))
+		case 9:
+			return r.node(append(append([]byte{}, val[1:]...), 0, 0, 0, 1))
+		default:
+			return nil, fmt.Errorf("invalid reference root: %x", val)
+		}
+	}
+	return r.decode(rootKey, val)
+}
+
+// iavlVersions are the versions a store's IAVL tree still has roots for:
+// any set of legacy versions, then a contiguous range of new-format ones,
+// which are only ever pruned from the start.
+type iavlVersions struct {
+	legacy        map[int64]bool
+	legacyLatest  int64
+	first, latest int64
+}
+
+func (v iavlVersions) has(version int64) bool {
+	if version <= v.legacyLatest {
+		return v.legacy[version]
+	}
+	return v.first > 0 && v.first <= version && version <= v.latest
+}
+
+// versions reads the tree's root keys the way the iavl package does: legacy
+// roots are listed, the newest new-format version is that of the last node
+// key, and the oldest is found by a binary search over the root keys.
+func (r *iavlNodeReader) versions() (iavlVersions, error) {
+	v := iavlVersions{legacy: map[int64]bool{}}
+	itr, err := r.db.Iterator([]byte{'r'}, []byte{'s'})
+	if err != nil {
+		return v, err
+	}
+	for ; itr.Valid(); itr.Next() {
+		if key := itr.Key(); len(key) == 9 {
+			version := int64(binary.BigEndian.Uint64(key[1:]))
+			v.legacy[version] = true
+			v.legacyLatest = max(v.legacyLatest, version)
+		}
+	}
+	err = itr.Error()
+	itr.Close()
+	if err != nil {
+		return v, err
+	}
+
+	itr, err = r.db.ReverseIterator([]byte{'s'}, []byte{'t'})
+	if err != nil {
+		return v, err
+	}
+	if itr.Valid() && len(itr.Key()) == 13 {
+		v.latest = int64(binary.BigEndian.Uint64(itr.Key()[1:]))
+	}
+	err = itr.Error()
+	itr.Close()
+	if err != nil || v.latest <= v.legacyLatest {
+		v.latest = 0
+		return v, err
+	}
+
+	lo, hi := v.legacyLatest+1, v.latest
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		has, err := r.db.Has(append([]byte{'s'}, iavlNodeKey(mid, 1)...))
+		if err != nil {
+			return v, err
+		}
+		if has {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	v.first = lo
+	return v, nil
+}
+
+// node loads a node by its 12-byte node key or 32-byte legacy hash.
+func (r *iavlNodeReader) node(nk []byte) (*iavlNode, error) {
+	var dbKey []byte
+	if len(nk) == 32 {
+		dbKey = append([]byte{'n'}, nk...)
+	} else {
+		dbKey = append([]byte{'s'}, nk...)
+	}
+	buf, err := r.db.Get(dbKey)
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("IAVL node %x not found", nk)
+	}
+	return r.decode(nk, buf)
+}
+
+func (r *iavlNodeReader) decode(nk, buf []byte) (*iavlNode, error) {
+	r.reads++
+	d := &nodeDecoder{buf: buf}
+	legacy := len(nk) == 32
+
+	node := &iavlNode{height: int8(d.varint())}
+	d.varint() // size
+	if legacy {
+		d.varint() // version
+		node.hash = nk
+	}
+	node.key = d.bytes()
+
+	if node.isLeaf() {
+		node.value = d.bytes()
+		return node, d.err
+	}
+
+	if legacy {
+		node.left = d.bytes()
+		node.right = d.bytes()
+		return node, d.err
+	}
+
+	node.hash = d.bytes()
+	mode := d.varint()
+	if mode&1 != 0 {
+		node.left = d.bytes()
+	} else {
+		node.left = iavlNodeKey(d.varint(), uint32(d.varint()))
+	}
+	if mode&2 != 0 {
+		node.right = d.bytes()
+	} else {
+		node.right = iavlNodeKey(d.varint(), uint32(d.varint()))
+	}
+	return node, d.err
+}
+
+func (r *iavlNodeReader) children(n *iavlNode) (*iavlNode, *iavlNode, error) {
+	left, err := r.node(n.left)
+	if err != nil {
+		return nil, nil, err
+	}
+	right, err := r.node(n.right)
+	if err != nil {
+		return nil, nil, err
+	}
+	return left, right, nil
+}
+
+func iavlNodeKey(version int64, nonce uint32) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, uint64(version))
+	binary.BigEndian.PutUint32(b[8:], nonce)
+	return b
+}
+
+// nodeDecoder reads the varint-prefixed fields of an encoded node and keeps
+// the first error so decode can check once at the end.
+type nodeDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *nodeDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errors.New("malformed varint in IAVL node")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *nodeDecoder) bytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	size, n := binary.Uvarint(d.buf)
+	if n <= 0 || uint64(len(d.buf)-n) < size {
+		d.err = errors.New("malformed byte slice in IAVL node")
+		return nil
+	}
+	b := d.buf[n : n+int(size)]
+	d.buf = d.buf[n+int(size):]
+	return b
+}
+
+// ctxCheckInterval is how many steps the diff loops take between checks for
+// cancellation.
+const ctxCheckInterval = 1024
+
+type iavlDiffStats struct {
+	NodesRead       int
+	SubtreesSkipped int
+}
+
+// diffIAVLTrees walks both trees from their roots and calls emit for every
+// leaf that differs, in key order, until emit returns false. When after is
+// set, only keys strictly greater than it are considered. The walk stops with
+// ctx's error once ctx is done.
+//
+// Each side keeps a stack of pending subtrees in key order. Whenever the two
+// tops carry the same hash they hold identical leaves and are dropped from
+// both sides, which leaves the symmetric difference unchanged; otherwise the
+// taller top is split into its children. The cost therefore follows the size
+// of the change, not the size of the store.
+func diffIAVLTrees(ctx context.Context, r1, r2 *iavlNodeReader, ver1, ver2 int64, after []byte, emit func(StoreDifference) bool) (stats iavlDiffStats, err error) {
+	defer func() { stats.NodesRead = r1.reads + r2.reads }()
+
+	var stack1, stack2 []*iavlNode
+	root1, err := r1.root(ver1)
+	if err != nil {
+		return stats, fmt.Errorf("source1: %v", err)
+	}
+	root2, err := r2.root(ver2)
+	if err != nil {
+		return stats, fmt.Errorf("source2: %v", err)
+	}
+	if root1 != nil {
+		stack1 = append(stack1, root1)
+	}
+	if root2 != nil {
+		stack2 = append(stack2, root2)
+	}
+
+	expand := func(r *iavlNodeReader, stack []*iavlNode) ([]*iavlNode, error) {
+		top := stack[len(stack)-1]
+		// An inner node's key is the smallest key of its right subtree, so the
+		// whole left subtree sorts at or before it.
+		if after != nil && bytes.Compare(top.key, after) <= 0 {
+			right, err := r.node(top.right)
+			if err != nil {
+				return nil, err
+			}
+			return append(stack[:len(stack)-1], right), nil
+		}
+		left, right, err := r.children(top)
+		if err != nil {
+			return nil, err
+		}
+		return append(stack[:len(stack)-1], right, left), nil
+	}
+
+	for steps := 0; len(stack1) > 0 || len(stack2) > 0; steps++ {
+		if steps%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+		}
+		var n1, n2 *iavlNode
+		if len(stack1) > 0 {
+			n1 = stack1[len(stack1)-1]
+		}
+		if len(stack2) > 0 {
+			n2 = stack2[len(stack2)-1]
+		}
+
+		switch {
+		case n1 != nil && n2 != nil && n1.hash != nil && bytes.Equal(n1.hash, n2.hash):
+			stack1 = stack1[:len(stack1)-1]
+			stack2 = stack2[:len(stack2)-1]
+			stats.SubtreesSkipped++
+			continue
+		case n1 != nil && !n1.isLeaf() && (n2 == nil || n2.isLeaf() || n1.height >= n2.height):
+			if stack1, err = expand(r1, stack1); err != nil {
+				return stats, fmt.Errorf("source1: %v", err)
+			}
+			continue
+		case n2 != nil && !n2.isLeaf():
+			if stack2, err = expand(r2, stack2); err != nil {
+				return stats, fmt.Errorf("source2: %v", err)
+			}
+			continue
+		}
+
+		// Both tops are leaves, or one side is exhausted.
+		if after != nil && n1 != nil && bytes.Compare(n1.key, after) <= 0 {
+			stack1 = stack1[:len(stack1)-1]
+			continue
+		}
+		if after != nil && n2 != nil && bytes.Compare(n2.key, after) <= 0 {
+			stack2 = stack2[:len(stack2)-1]
+			continue
+		}
+		var diff StoreDifference
+		var found bool
+		switch {
+		case n2 == nil || (n1 != nil && bytes.Compare(n1.key, n2.key) < 0):
+			diff, found = makeStoreDifference("key_only_source1", n1.key, n1.value, nil), true
+			stack1 = stack1[:len(stack1)-1]
+		case n1 == nil || bytes.Compare(n1.key, n2.key) > 0:
+			diff, found = makeStoreDifference("key_only_source2", n2.key, nil, n2.value), true
+			stack2 = stack2[:len(stack2)-1]
+		default:
+			if !bytes.Equal(n1.value, n2.value) {
+				diff, found = makeStoreDifference("value_differ", n1.key, n1.value, n2.value), true
+			}
+			stack1 = stack1[:len(stack1)-1]
+			stack2 = stack2[:len(stack2)-1]
+		}
+		if found && !emit(diff) {
+			break
+		}
+	}
+	return stats, nil
+}
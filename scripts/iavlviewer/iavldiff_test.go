@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"cosmossdk.io/log"
+	"cosmossdk.io/store/wrapper"
+	dbm "github.com/cosmos/cosmos-db"
+	"github.com/cosmos/iavl"
+)
+
+// newStoreTree returns an IAVL tree laid out in db as the multistore keeps
+// the store named storeName.
+func newStoreTree(db dbm.DB, storeName string) *iavl.MutableTree {
+	return iavl.NewMutableTree(wrapper.NewDBWrapper(dbm.NewPrefixDB(db, []byte("s/k:"+storeName+"/"))), 0, true, log.NewNopLogger())
+}
+
+func TestIAVLVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := newStoreTree(db, "bank")
+	for v := 1; v <= 10; v++ {
+		// Versions 6 and 7 change nothing and only store a reference root.
+		if v != 6 && v != 7 {
+			if _, err := tree.Set([]byte(fmt.Sprintf("key%d", v)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := tree.SaveVersion(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.DeleteVersionsTo(4); err != nil {
+		t.Fatal(err)
+	}
+
+	available, err := newIAVLNodeReader(db, "bank").versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available.first != 5 || available.latest != 10 {
+		t.Errorf("versions %d-%d, want 5-10", available.first, available.latest)
+	}
+	reopened := newStoreTree(db, "bank")
+	for v := int64(0); v <= 12; v++ {
+		if got, want := available.has(v), reopened.VersionExists(v); got != want {
+			t.Errorf("has(%d) = %v, iavl says %v", v, got, want)
+		}
+	}
+
+	// Legacy roots may have been pruned in any pattern.
+	legacy := dbm.NewPrefixDB(db, []byte("s/k:legacy/"))
+	for _, v := range []uint64{2, 5} {
+		legacy.Set(binary.BigEndian.AppendUint64([]byte{'r'}, v), make([]byte, 32))
+	}
+	available, err = newIAVLNodeReader(db, "legacy").versions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for v, want := range map[int64]bool{1: false, 2: true, 3: false, 5: true, 6: false} {
+		if available.has(v) != want {
+			t.Errorf("legacy has(%d) = %v, want %v", v, !want, want)
+		}
+	}
+}
+
+// kvOp sets key to value, or deletes key when value is empty.
+type kvOp struct{ key, value string }
+
+func setAll(value string, keys ...string) []kvOp {
+	ops := make([]kvOp, len(keys))
+	for i, k := range keys {
+		ops[i] = kvOp{k, value}
+	}
+	return ops
+}
+
+func baseKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%04d", i)
+	}
+	return keys
+}
+
+// saveVersions writes one version of the store's tree in db per element of
+// versions and returns the reader for the store.
+func saveVersions(t *testing.T, db dbm.DB, versions ...[]kvOp) *iavlNodeReader {
+	t.Helper()
+	tree := newStoreTree(db, "bank")
+	if _, err := tree.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ops := range versions {
+		for _, op := range ops {
+			var err error
+			if op.value == "" {
+				_, _, err = tree.Remove([]byte(op.key))
+			} else {
+				_, err = tree.Set([]byte(op.key), []byte(op.value))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := tree.SaveVersion(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newIAVLNodeReader(db, "bank")
+}
+
+func formatDiffs(diffs []StoreDifference) []string {
+	out := make([]string, len(diffs))
+	for i, d := range diffs {
+		out[i] = fmt.Sprintf("%s %s %s %s", d.Type, d.Key, d.Value1, d.Value2)
+	}
+	return out
+}
+
+func TestDiffIAVLTrees(t *testing.T) {
+	base := setAll("v", baseKeys(50)...)
+	tests := []struct {
+		name    string
+		source1 [][]kvOp
+		source2 [][]kvOp
+		ver1    int64
+		ver2    int64
+		after   string
+		want    []string
+	}{
+		{
+			name:    "identical",
+			source1: [][]kvOp{base},
+			source2: [][]kvOp{base},
+		},
+		{
+			name:    "value changed",
+			source1: [][]kvOp{base},
+			source2: [][]kvOp{base, {{"k0010", "w"}}},
+			ver2:    2,
+			want:    []string{"value_differ k0010 v w"},
+		},
+		{
+			name:    "keys added and removed",
+			source1: [][]kvOp{base},
+			source2: [][]kvOp{base, {{"k0005", ""}, {"k0005a", "w"}, {"k9999", "w"}}},
+			ver2:    2,
+			want: []string{
+				"key_only_source1 k0005 v ",
+				"key_only_source2 k0005a  w",
+				"key_only_source2 k9999  w",
+			},
+		},
+		{
+			name:    "empty source1",
+			source1: [][]kvOp{nil},
+			source2: [][]kvOp{setAll("w", "a", "b", "c")},
+			want: []string{
+				"key_only_source2 a  w",
+				"key_only_source2 b  w",
+				"key_only_source2 c  w",
+			},
+		},
+		{
+			name:    "empty source2",
+			source1: [][]kvOp{setAll("v", "a", "b")},
+			source2: [][]kvOp{nil},
+			want: []string{
+				"key_only_source1 a v ",
+				"key_only_source1 b v ",
+			},
+		},
+		{
+			name:    "after cursor",
+			source1: [][]kvOp{base},
+			source2: [][]kvOp{base, {{"k0003", "w"}, {"k0020", "w"}, {"k0040", ""}, {"k0040a", "w"}}},
+			ver2:    2,
+			after:   "k0020",
+			want: []string{
+				"key_only_source1 k0040 v ",
+				"key_only_source2 k0040a  w",
+			},
+		},
+		{
+			name:    "after cursor past the last difference",
+			source1: [][]kvOp{base},
+			source2: [][]kvOp{base, {{"k0003", "w"}}},
+			ver2:    2,
+			after:   "k0003",
+		},
+		{
+			name:    "after cursor between keys",
+			source1: [][]kvOp{base},
+			source2: [][]kvOp{base, {{"k0003", "w"}, {"k0004", "w"}}},
+			ver2:    2,
+			after:   "k0003a",
+			want:    []string{"value_differ k0004 v w"},
+		},
+		{
+			name:    "older version with a reference root",
+			source1: [][]kvOp{base, nil, {{"k0007", "w"}}},
+			source2: [][]kvOp{base},
+			ver1:    2,
+			ver2:    1,
+		},
+		{
+			name:    "newer version of the same history",
+			source1: [][]kvOp{base, nil, {{"k0007", "w"}}},
+			source2: [][]kvOp{base},
+			ver1:    3,
+			ver2:    1,
+			want:    []string{"value_differ k0007 w v"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r1 := saveVersions(t, dbm.NewMemDB(), tt.source1...)
+			r2 := saveVersions(t, dbm.NewMemDB(), tt.source2...)
+			ver1, ver2 := max(tt.ver1, 1), max(tt.ver2, 1)
+			var after []byte
+			if tt.after != "" {
+				after = []byte(tt.after)
+			}
+			var diffs []StoreDifference
+			_, err := diffIAVLTrees(context.Background(), r1, r2, ver1, ver2, after, func(d StoreDifference) bool {
+				diffs = append(diffs, d)
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := formatDiffs(diffs)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("diffs:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// TestDiffIAVLTreesPages walks a diff in pages the way
+// /comparisons/{id}/differences does and checks the pages add up to the
+// whole diff.
+func TestDiffIAVLTreesPages(t *testing.T) {
+	keys := baseKeys(200)
+	var changes []kvOp
+	for i := 0; i < len(keys); i += 17 {
+		changes = append(changes, kvOp{keys[i], "w"})
+	}
+	changes = append(changes, kvOp{"k0050", ""}, kvOp{"k0100x", "w"})
+	r1 := saveVersions(t, dbm.NewMemDB(), setAll("v", keys...))
+	r2 := saveVersions(t, dbm.NewMemDB(), setAll("v", keys...), changes)
+
+	var all []StoreDifference
+	if _, err := diffIAVLTrees(context.Background(), r1, r2, 1, 2, nil, func(d StoreDifference) bool {
+		all = append(all, d)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(changes) {
+		t.Fatalf("%d differences, want %d", len(all), len(changes))
+	}
+
+	const limit = 3
+	var paged []StoreDifference
+	var after []byte
+	for pages := 0; ; pages++ {
+		if pages > len(all) {
+			t.Fatal("paging does not advance")
+		}
+		var page []StoreDifference
+		if _, err := diffIAVLTrees(context.Background(), r1, r2, 1, 2, after, func(d StoreDifference) bool {
+			page = append(page, d)
+			return len(page) <= limit
+		}); err != nil {
+			t.Fatal(err)
+		}
+		hasMore := len(page) > limit
+		if hasMore {
+			page = page[:limit]
+		}
+		paged = append(paged, page...)
+		if !hasMore {
+			break
+		}
+		after = []byte(page[len(page)-1].Key)
+	}
+	if got, want := formatDiffs(paged), formatDiffs(all); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("pages:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDiffIAVLTreesSkipsSharedSubtrees(t *testing.T) {
+	keys := baseKeys(5000)
+	r1 := saveVersions(t, dbm.NewMemDB(), setAll("v", keys...))
+	r2 := saveVersions(t, dbm.NewMemDB(), setAll("v", keys...), []kvOp{{"k2500", "w"}})
+	var diffs []StoreDifference
+	stats, err := diffIAVLTrees(context.Background(), r1, r2, 1, 2, nil, func(d StoreDifference) bool {
+		diffs = append(diffs, d)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatDiffs(diffs); len(got) != 1 || got[0] != "value_differ k2500 v w" {
+		t.Errorf("diffs = %q", got)
+	}
+	// One changed leaf touches a path of about log2(5000) nodes per tree.
+	if stats.NodesRead > 100 || stats.SubtreesSkipped == 0 {
+		t.Errorf("read %d nodes and skipped %d subtrees", stats.NodesRead, stats.SubtreesSkipped)
+	}
+}
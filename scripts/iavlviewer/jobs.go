@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	JobQueued           = "queued"
+	JobPreparingSource1 = "preparing_source1"
+	JobPreparingSource2 = "preparing_source2"
+	JobComparing        = "comparing"
+	JobDone             = "done"
+	JobFailed           = "failed"
+	JobCancelled        = "cancelled"
+)
+
+// jobRetention is how long finished jobs stay queryable under /jobs/{id}.
+const jobRetention = 24 * time.Hour
+
+// maxJobRuntime bounds every comparison the server runs, async or not. Zero
+// disables the limit.
+var maxJobRuntime time.Duration
+
+// comparisonContext derives the context a comparison runs under, applying
+// maxJobRuntime.
+func comparisonContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if maxJobRuntime > 0 {
+		return context.WithTimeout(parent, maxJobRuntime)
+	}
+	return context.WithCancel(parent)
+}
+
+type JobStatus struct {
+	ID      string `json:"id"`
+	State   string `json:"state,omitempty"` // one of the Job* constants
+	Message string `json:"message,omitempty"`
+	// QueuePosition is the job's 1-based place in the queue while queued.
+	QueuePosition int    `json:"queue_position,omitempty"`
+	Store         string `json:"store,omitempty"`
+	StoreIndex    int    `json:"store_index,omitempty"`
+	StoreCount    int    `json:"store_count,omitempty"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     string `json:"created_at,omitempty"`
+	UpdatedAt     string `json:"updated_at,omitempty"`
+	StatusURL     string `json:"status_url,omitempty"`
+	ResultURL     string `json:"result_url,omitempty"`
+	EventsURL     string `json:"events_url,omitempty"`
+}
+
+type job struct {
+	mu         sync.Mutex
+	status     JobStatus
+	result     *CompareResponse
+	finishedAt time.Time
+	cancel     context.CancelFunc
+	// owner is the client that started the job; see requestOwner.
+	owner string
+
+	// events is the progress log replayed to /jobs/{id}/events subscribers.
+	// changed is closed and replaced whenever an event is added.
+	events  []ProgressEvent
+	seq     int64
+	changed chan struct{}
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = map[string]*job{}
+)
+
+// startJob runs the comparison in the background once ticket is admitted and
+// returns its initial status right away.
+func startJob(req CompareRequest, ticket *queueTicket, onFinish func()) JobStatus {
+	id := generateTaskID()
+	now := time.Now().UTC().Format(time.RFC3339)
+	j := &job{
+		status: JobStatus{
+			ID:        id,
+			State:     JobQueued,
+			Message:   "waiting to start",
+			CreatedAt: now,
+			UpdatedAt: now,
+			StatusURL: "/jobs/" + id,
+			ResultURL: "/jobs/" + id + "/result",
+			EventsURL: "/jobs/" + id + "/events",
+		},
+		changed: make(chan struct{}),
+		owner:   req.Owner,
+	}
+
+	// The runtime limit starts once the job leaves the queue; cancelling
+	// works in both places.
+	queued, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+
+	jobsMu.Lock()
+	jobs[id] = j
+	jobsMu.Unlock()
+
+	ticket.watch(func(pos int) {
+		j.update(ProgressEvent{Event: EventQueued, Stage: JobQueued, QueuePosition: pos})
+	})
+
+	go func() {
+		defer onFinish()
+		defer cancel()
+		defer ticket.done()
+		if err := ticket.wait(queued); err != nil {
+			response := CompareResponse{Success: false, Error: err.Error(), ErrorType: errorType(err)}
+			if queued.Err() != nil {
+				response.Error = "Comparison was cancelled"
+			}
+			j.finish(response, queued.Err())
+			fmt.Printf("[Jobs] %s left the queue: state=%s\n", id, j.snapshot().State)
+			return
+		}
+		ctx, stop := comparisonContext(queued)
+		defer stop()
+		response := runComparison(ctx, id, req, j.update)
+		j.finish(response, ctx.Err())
+		fmt.Printf("[Jobs] %s finished: state=%s\n", id, j.snapshot().State)
+	}()
+
+	return j.ownerStatus()
+}
+
+// lookupJob returns the job with the given ID if it belongs to the client of
+// r. Other clients' jobs are reported as missing.
+func lookupJob(r *http.Request, id string) *job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if j := jobs[id]; j != nil && j.owner == requestOwner(r) {
+		return j
+	}
+	return nil
+}
+
+func (j *job) update(ev ProgressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.State = ev.Stage
+	j.status.QueuePosition = ev.QueuePosition
+	j.status.Store = ev.Store
+	j.status.StoreIndex = ev.StoreIndex
+	j.status.StoreCount = ev.StoreCount
+	j.status.Message = describeProgress(ev)
+	j.status.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	j.appendEvent(ev)
+}
+
+// finish records the job's response. ctxErr is the error of the job's context,
+// which tells a cancellation or timeout apart from an ordinary failure.
+func (j *job) finish(response CompareResponse, ctxErr error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	j.status.Store, j.status.StoreIndex, j.status.StoreCount = "", 0, 0
+	j.status.QueuePosition = 0
+	j.result = &response
+	switch {
+	case response.Success:
+		j.status.State = JobDone
+		j.status.Message = "comparison finished"
+	case errors.Is(ctxErr, context.Canceled):
+		j.status.State = JobCancelled
+		j.status.Message = "comparison cancelled"
+		j.status.Error = response.Error
+	default:
+		j.status.State = JobFailed
+		j.status.Message = "comparison failed"
+		j.status.Error = response.Error
+	}
+	j.status.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	j.appendEvent(ProgressEvent{Event: EventFinished, Stage: j.status.State, Error: response.Error})
+}
+
+// appendEvent numbers ev and wakes up subscribers. A download or extract
+// event replaces the previous one of the same kind so the log stays short.
+// Callers hold j.mu.
+func (j *job) appendEvent(ev ProgressEvent) {
+	j.seq++
+	ev.Seq = j.seq
+	if n := len(j.events); n > 0 && (ev.Event == EventDownload || ev.Event == EventExtract) {
+		prev := j.events[n-1]
+		if prev.Event == ev.Event && prev.Source == ev.Source {
+			j.events = j.events[:n-1]
+		}
+	}
+	j.events = append(j.events, ev)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// eventsAfter returns the logged events numbered after seq, a channel that is
+// closed when more arrive, and whether the job has finished.
+func (j *job) eventsAfter(seq int64) ([]ProgressEvent, <-chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i := len(j.events)
+	for i > 0 && j.events[i-1].Seq > seq {
+		i--
+	}
+	return append([]ProgressEvent(nil), j.events[i:]...), j.changed, j.result != nil
+}
+
+func (j *job) snapshot() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// ownerStatus is the status as returned to the job's owner. With
+// authentication enabled its events_url carries a fresh events token, so a
+// browser EventSource can open it as is.
+func (j *job) ownerStatus() JobStatus {
+	status := j.snapshot()
+	if authTokens != nil {
+		status.EventsURL += "?token=" + newEventsToken(status.ID, j.owner, time.Now())
+	}
+	return status
+}
+
+func describeProgress(ev ProgressEvent) string {
+	switch ev.Event {
+	case EventQueued:
+		return fmt.Sprintf("queued at position %d", ev.QueuePosition)
+	case EventDownload:
+		if ev.BytesTotal > 0 {
+			return fmt.Sprintf("downloading %s: %d of %d bytes", ev.Source, ev.BytesDownloaded, ev.BytesTotal)
+		}
+		return fmt.Sprintf("downloading %s: %d bytes", ev.Source, ev.BytesDownloaded)
+	case EventExtract:
+		if ev.FilesTotal > 0 {
+			return fmt.Sprintf("extracting %s: %d of %d files", ev.Source, ev.FilesExtracted, ev.FilesTotal)
+		}
+		return fmt.Sprintf("extracting %s: %d files", ev.Source, ev.FilesExtracted)
+	case EventCacheHit:
+		return fmt.Sprintf("using cached %s", ev.Source)
+	case EventStoresMounted:
+		return fmt.Sprintf("mounted %d stores", ev.StoresMounted)
+	case EventStoreStarted, EventStoreFinished:
+		return fmt.Sprintf("comparing store %s (%d of %d)", ev.Store, ev.StoreIndex, ev.StoreCount)
+	}
+	switch ev.Stage {
+	case JobPreparingSource1:
+		return "preparing source1"
+	case JobPreparingSource2:
+		return "preparing source2"
+	case JobComparing:
+		return "comparing stores"
+	default:
+		return ev.Stage
+	}
+}
+
+// cancelJob stops a running job. It returns false if the job had already
+// finished.
+func (j *job) cancelJob() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.result != nil {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+// pruneJobs forgets finished jobs once jobRetention has passed.
+func pruneJobs(interval time.Duration) {
+	for range time.Tick(interval) {
+		jobsMu.Lock()
+		for id, j := range jobs {
+			j.mu.Lock()
+			expired := !j.finishedAt.IsZero() && time.Since(j.finishedAt) > jobRetention
+			j.mu.Unlock()
+			if expired {
+				delete(jobs, id)
+			}
+		}
+		jobsMu.Unlock()
+	}
+}
+
+func handleJobStatusAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[Jobs] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(JobStatus{Error: "Method not allowed. Use GET or DELETE."})
+		return
+	}
+
+	j := lookupJob(r, r.PathValue("id"))
+	if j == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(JobStatus{ID: r.PathValue("id"), Error: "Job not found"})
+		return
+	}
+
+	// DELETE only requests cancellation; the job reports "cancelled" once the
+	// comparison has stopped and its inputs are removed.
+	if r.Method == http.MethodDelete {
+		if !j.cancelJob() {
+			status := j.ownerStatus()
+			status.Error = "Job has already finished"
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		fmt.Printf("[Jobs] Cancellation requested for %s\n", r.PathValue("id"))
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(j.ownerStatus())
+}
+
+func handleJobResultAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[Jobs] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   "Method not allowed. Use GET.",
+		})
+		return
+	}
+
+	j := lookupJob(r, r.PathValue("id"))
+	if j == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   "Job not found",
+		})
+		return
+	}
+
+	j.mu.Lock()
+	result, status := j.result, j.status
+	j.mu.Unlock()
+
+	// Still running: answer with the current status so clients can keep polling.
+	if result == nil {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	if !result.Success {
+		w.WriteHeader(failureStatus(*result))
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+// defaultBech32Prefix is used for addresses in decoded keys unless
+// CompareOptions.Bech32Prefix says otherwise.
+const defaultBech32Prefix = "cosmos"
+
+// DecodedKey is a store key split into the fields its module encoded in it.
+type DecodedKey struct {
+	Module string `json:"module"`
+	// Prefix names the key's prefix byte, e.g. "balances" or "validator".
+	Prefix string     `json:"prefix"`
+	Fields []KeyField `json:"fields,omitempty"`
+}
+
+// KeyField is one field of a decoded key, rendered for display: addresses
+// as bech32, numbers in decimal, times in RFC 3339.
+type KeyField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (k *DecodedKey) String() string {
+	var sb strings.Builder
+	sb.WriteString(k.Module + "/" + k.Prefix)
+	for _, f := range k.Fields {
+		fmt.Fprintf(&sb, " %s=%s", f.Name, f.Value)
+	}
+	return sb.String()
+}
+
+// keyPrefix describes the keys under one prefix byte. decode reads the bytes
+// after the prefix; it is nil for singleton keys such as params.
+type keyPrefix struct {
+	name   string
+	decode func(r *keyReader)
+}
+
+// moduleKeys maps the prefix bytes of a module's store to their layouts.
+type moduleKeys struct {
+	module   string
+	prefixes map[byte]keyPrefix
+	// names are keys stored as plain strings by older SDK versions.
+	names map[string]string
+	// decodeKey replaces the prefix table for stores whose keys aren't
+	// prefixed by a byte.
+	decodeKey func(key []byte) *DecodedKey
+}
+
+// Chains whose stores are decoded with their own key layouts. Stores of the
+// same name hold different keys on Heimdall, which forked an older SDK.
+const (
+	chainCosmos   = "cosmos"
+	chainHeimdall = "heimdall"
+)
+
+// keyDecoders is the registry of key layouts, by chain and store name. The
+// cosmos layouts cover SDK v0.46 to v0.50; where collections changed the
+// encoding (terminal addresses without a length prefix, big-endian counters)
+// both are accepted.
+var keyDecoders = map[string]map[string]*moduleKeys{}
+
+func registerKeyDecoder(chain, storeName string, keys *moduleKeys) {
+	if keyDecoders[chain] == nil {
+		keyDecoders[chain] = map[string]*moduleKeys{}
+	}
+	keyDecoders[chain][storeName] = keys
+}
+
+func init() {
+	registerKeyDecoder(chainCosmos, "bank", &moduleKeys{module: "bank", prefixes: map[byte]keyPrefix{
+		0x00: {"supply", func(r *keyReader) { r.str("denom") }},
+		0x01: {"denom_metadata", func(r *keyReader) { r.str("denom") }},
+		0x02: {"balances", func(r *keyReader) { r.address("address", addrAccount); r.str("denom") }},
+		0x03: {"denom_address", func(r *keyReader) { r.strNul("denom"); r.lastAddress("address", addrAccount) }},
+		0x04: {"send_enabled", func(r *keyReader) { r.str("denom") }},
+		0x05: {"params", nil},
+	}})
+
+	registerKeyDecoder(chainCosmos, "staking", &moduleKeys{module: "staking", prefixes: map[byte]keyPrefix{
+		0x11: {"last_validator_power", func(r *keyReader) { r.address("validator", addrValoper) }},
+		0x12: {"last_total_power", nil},
+		0x21: {"validator", func(r *keyReader) { r.address("validator", addrValoper) }},
+		0x22: {"validator_by_cons_addr", func(r *keyReader) { r.address("cons_address", addrValcons) }},
+		0x23: {"validator_by_power", func(r *keyReader) { r.uint64("power"); r.invertedAddress("validator", addrValoper) }},
+		0x31: {"delegation", func(r *keyReader) { r.address("delegator", addrAccount); r.address("validator", addrValoper) }},
+		0x32: {"unbonding_delegation", func(r *keyReader) { r.address("delegator", addrAccount); r.address("validator", addrValoper) }},
+		0x33: {"unbonding_delegation_by_validator", func(r *keyReader) { r.address("validator", addrValoper); r.address("delegator", addrAccount) }},
+		0x34: {"redelegation", func(r *keyReader) {
+			r.address("delegator", addrAccount)
+			r.address("src_validator", addrValoper)
+			r.address("dst_validator", addrValoper)
+		}},
+		0x35: {"redelegation_by_src_validator", func(r *keyReader) {
+			r.address("src_validator", addrValoper)
+			r.address("delegator", addrAccount)
+			r.address("dst_validator", addrValoper)
+		}},
+		0x36: {"redelegation_by_dst_validator", func(r *keyReader) {
+			r.address("dst_validator", addrValoper)
+			r.address("delegator", addrAccount)
+			r.address("src_validator", addrValoper)
+		}},
+		0x37: {"unbonding_id", nil},
+		0x38: {"unbonding_index", func(r *keyReader) { r.uint64("unbonding_id") }},
+		0x39: {"unbonding_type", func(r *keyReader) { r.uint64("unbonding_id") }},
+		0x41: {"unbonding_queue", func(r *keyReader) { r.time("completion_time") }},
+		0x42: {"redelegation_queue", func(r *keyReader) { r.time("completion_time") }},
+		0x43: {"validator_queue", func(r *keyReader) { r.uint64(""); r.time("completion_time"); r.uint64("height") }},
+		0x50: {"historical_info", func(r *keyReader) { r.height("height") }},
+		0x51: {"params", nil},
+		0x61: {"validator_updates", nil},
+		0x71: {"delegation_by_validator", func(r *keyReader) { r.address("validator", addrValoper); r.lastAddress("delegator", addrAccount) }},
+	}})
+
+	authKeys := &moduleKeys{module: "auth", prefixes: map[byte]keyPrefix{
+		0x00: {"params", nil},
+		0x01: {"account", func(r *keyReader) { r.terminalAddress("address", addrAccount) }},
+		0x02: {"global_account_number", nil},
+		0x03: {"account_number", func(r *keyReader) { r.uint64("account_number") }},
+	}, names: map[string]string{"globalAccountNumber": "global_account_number"}}
+	registerKeyDecoder(chainCosmos, "acc", authKeys)
+	registerKeyDecoder(chainCosmos, "auth", authKeys)
+
+	registerKeyDecoder(chainCosmos, "distribution", &moduleKeys{module: "distribution", prefixes: map[byte]keyPrefix{
+		0x00: {"fee_pool", nil},
+		0x01: {"previous_proposer", nil},
+		0x02: {"validator_outstanding_rewards", func(r *keyReader) { r.address("validator", addrValoper) }},
+		0x03: {"delegator_withdraw_address", func(r *keyReader) { r.address("delegator", addrAccount) }},
+		0x04: {"delegator_starting_info", func(r *keyReader) { r.address("validator", addrValoper); r.lastAddress("delegator", addrAccount) }},
+		0x05: {"validator_historical_rewards", func(r *keyReader) { r.address("validator", addrValoper); r.period("period") }},
+		0x06: {"validator_current_rewards", func(r *keyReader) { r.address("validator", addrValoper) }},
+		0x07: {"validator_accumulated_commission", func(r *keyReader) { r.address("validator", addrValoper) }},
+		0x08: {"validator_slash_event", func(r *keyReader) { r.address("validator", addrValoper); r.uint64("height"); r.uint64("period") }},
+		0x09: {"params", nil},
+	}})
+
+	registerKeyDecoder(chainCosmos, "slashing", &moduleKeys{module: "slashing", prefixes: map[byte]keyPrefix{
+		0x00: {"params", nil},
+		0x01: {"validator_signing_info", func(r *keyReader) { r.address("cons_address", addrValcons) }},
+		0x02: {"validator_missed_block_bitmap", func(r *keyReader) { r.address("cons_address", addrValcons); r.int64Key("index") }},
+		0x03: {"address_pubkey_relation", func(r *keyReader) { r.address("address", addrAccount) }},
+	}})
+
+	registerKeyDecoder(chainCosmos, "gov", &moduleKeys{module: "gov", prefixes: map[byte]keyPrefix{
+		0x00: {"proposal", func(r *keyReader) { r.uint64("proposal_id") }},
+		0x01: {"active_proposal_queue", func(r *keyReader) { r.time("end_time"); r.uint64("proposal_id") }},
+		0x02: {"inactive_proposal_queue", func(r *keyReader) { r.time("end_time"); r.uint64("proposal_id") }},
+		0x03: {"next_proposal_id", nil},
+		0x04: {"voting_period_proposal", func(r *keyReader) { r.uint64("proposal_id") }},
+		0x10: {"deposit", func(r *keyReader) { r.uint64("proposal_id"); r.lastAddress("depositor", addrAccount) }},
+		0x20: {"vote", func(r *keyReader) { r.uint64("proposal_id"); r.lastAddress("voter", addrAccount) }},
+		0x30: {"params", nil},
+		0x31: {"constitution", nil},
+	}})
+
+	registerKeyDecoder(chainCosmos, "mint", &moduleKeys{module: "mint", prefixes: map[byte]keyPrefix{
+		0x00: {"minter", nil},
+		0x01: {"params", nil},
+	}})
+
+	// x/params keys are "<subspace>/<param>"; the values are amino JSON.
+	// Heimdall kept the same layout.
+	paramsKeys := &moduleKeys{module: "params", decodeKey: func(key []byte) *DecodedKey {
+		subspace, param, ok := strings.Cut(string(key), "/")
+		if !ok {
+			return nil
+		}
+		return &DecodedKey{Module: "params", Prefix: subspace, Fields: []KeyField{{Name: "param", Value: param}}}
+	}}
+	registerKeyDecoder(chainCosmos, "params", paramsKeys)
+	registerKeyDecoder(chainHeimdall, "params", paramsKeys)
+}
+
+// decodeStoreKey decodes key with the layout registered for storeName on
+// chain. It returns nil for stores without a decoder and for unknown prefixes;
+// bytes a layout can't account for are kept in a trailing "rest" field.
+func decodeStoreKey(chain, storeName string, key []byte, bech32Prefix string) *DecodedKey {
+	keys := keyDecoders[chain][storeName]
+	if keys == nil || len(key) == 0 {
+		return nil
+	}
+	if keys.decodeKey != nil {
+		return keys.decodeKey(key)
+	}
+	if name, ok := keys.names[string(key)]; ok {
+		return &DecodedKey{Module: keys.module, Prefix: name}
+	}
+	prefix, ok := keys.prefixes[key[0]]
+	if !ok {
+		return nil
+	}
+	if bech32Prefix == "" {
+		bech32Prefix = defaultBech32Prefix
+	}
+	r := &keyReader{rest: key[1:], bech32Prefix: bech32Prefix, ok: true}
+	if prefix.decode != nil {
+		prefix.decode(r)
+	}
+	if len(r.rest) > 0 {
+		r.fields = append(r.fields, KeyField{Name: "rest", Value: hex.EncodeToString(r.rest)})
+	}
+	return &DecodedKey{Module: keys.module, Prefix: prefix.name, Fields: r.fields}
+}
+
+// Address kinds, which select the bech32 prefix suffix. addrEthereum
+// addresses are rendered as 0x hex instead.
+const (
+	addrAccount  = ""
+	addrValoper  = "valoper"
+	addrValcons  = "valcons"
+	addrEthereum = "ethereum"
+)
+
+// keyReader consumes the fields of a key in order. Once a field fails to
+// decode it stops, leaving the remaining bytes for the "rest" field.
+type keyReader struct {
+	rest         []byte
+	bech32Prefix string
+	fields       []KeyField
+	ok           bool
+}
+
+func (r *keyReader) add(name, value string) {
+	if name != "" {
+		r.fields = append(r.fields, KeyField{Name: name, Value: value})
+	}
+}
+
+// take consumes n bytes, failing if fewer remain.
+func (r *keyReader) take(n int) ([]byte, bool) {
+	if !r.ok || n < 0 || len(r.rest) < n {
+		r.ok = false
+		return nil, false
+	}
+	b := r.rest[:n]
+	r.rest = r.rest[n:]
+	return b, true
+}
+
+func (r *keyReader) formatAddress(addr []byte, kind string) string {
+	if kind == addrEthereum {
+		return "0x" + hex.EncodeToString(addr)
+	}
+	s, err := bech32.EncodeFromBase256(r.bech32Prefix+kind, addr)
+	if err != nil {
+		return hex.EncodeToString(addr)
+	}
+	return s
+}
+
+// address reads a length-prefixed address.
+func (r *keyReader) address(name, kind string) {
+	if !r.ok || len(r.rest) == 0 {
+		r.ok = false
+		return
+	}
+	if addr, ok := r.take(int(r.rest[0]) + 1); ok {
+		r.add(name, r.formatAddress(addr[1:], kind))
+	}
+}
+
+// lastAddress reads an address that ends the key. SDK v0.50 collections
+// store these without the length prefix older versions used.
+func (r *keyReader) lastAddress(name, kind string) {
+	if !r.ok || len(r.rest) == 0 {
+		r.ok = false
+		return
+	}
+	if int(r.rest[0]) == len(r.rest)-1 {
+		r.address(name, kind)
+		return
+	}
+	addr, _ := r.take(len(r.rest))
+	r.add(name, r.formatAddress(addr, kind))
+}
+
+// terminalAddress reads an address that ends the key and is never length
+// prefixed, as in auth account keys.
+func (r *keyReader) terminalAddress(name, kind string) {
+	if !r.ok || len(r.rest) == 0 {
+		r.ok = false
+		return
+	}
+	addr, _ := r.take(len(r.rest))
+	r.add(name, r.formatAddress(addr, kind))
+}
+
+// fixedAddress reads an address of n bytes without a length prefix.
+func (r *keyReader) fixedAddress(name, kind string, n int) {
+	if addr, ok := r.take(n); ok {
+		r.add(name, r.formatAddress(addr, kind))
+	}
+}
+
+// invertedAddress reads a length-prefixed address stored with every bit
+// flipped, as in the validators-by-power index.
+func (r *keyReader) invertedAddress(name, kind string) {
+	if !r.ok || len(r.rest) == 0 {
+		r.ok = false
+		return
+	}
+	if b, ok := r.take(int(r.rest[0]) + 1); ok {
+		addr := make([]byte, len(b)-1)
+		for i, c := range b[1:] {
+			addr[i] = ^c
+		}
+		r.add(name, r.formatAddress(addr, kind))
+	}
+}
+
+func (r *keyReader) uint64(name string) {
+	if b, ok := r.take(8); ok {
+		r.add(name, strconv.FormatUint(binary.BigEndian.Uint64(b), 10))
+	}
+}
+
+// period reads a rewards period, stored little-endian before collections
+// and as a big-endian uint64 since SDK v0.50. Neither form marks itself, but
+// periods count up from zero, so the smaller reading is the right one.
+func (r *keyReader) period(name string) {
+	if b, ok := r.take(8); ok {
+		r.add(name, strconv.FormatUint(min(binary.BigEndian.Uint64(b), binary.LittleEndian.Uint64(b)), 10))
+	}
+}
+
+// int64Key reads a non-negative counter that SDK v0.50 stores with
+// collections.Int64Key: big-endian with the sign bit flipped, so it starts
+// with 0x80. Anything else is the little-endian form of earlier versions,
+// such as the v0.47 missed-block index.
+func (r *keyReader) int64Key(name string) {
+	if b, ok := r.take(8); ok {
+		if b[0] == 0x80 {
+			r.add(name, strconv.FormatUint(binary.BigEndian.Uint64(b)&^(1<<63), 10))
+		} else {
+			r.add(name, strconv.FormatUint(binary.LittleEndian.Uint64(b), 10))
+		}
+	}
+}
+
+// height reads a block height, stored as a decimal string before SDK v0.50
+// and since as a collections.Int64Key, big-endian with the sign bit flipped.
+func (r *keyReader) height(name string) {
+	if !r.ok {
+		return
+	}
+	if _, err := strconv.ParseUint(string(r.rest), 10, 64); err == nil {
+		r.str(name)
+		return
+	}
+	if b, ok := r.take(8); ok {
+		r.add(name, strconv.FormatUint(binary.BigEndian.Uint64(b)&^(1<<63), 10))
+	}
+}
+
+// str reads a string that ends the key, such as a denom.
+func (r *keyReader) str(name string) {
+	if b, ok := r.take(len(r.rest)); ok {
+		r.add(name, string(b))
+	}
+}
+
+// prefixByte consumes a prefix byte nested in the key, failing on any other.
+func (r *keyReader) prefixByte(b byte) {
+	if !r.ok || len(r.rest) == 0 || r.rest[0] != b {
+		r.ok = false
+		return
+	}
+	r.take(1)
+}
+
+// strNul reads a string terminated by a zero byte.
+func (r *keyReader) strNul(name string) {
+	if !r.ok {
+		return
+	}
+	i := bytes.IndexByte(r.rest, 0)
+	if i < 0 {
+		r.ok = false
+		return
+	}
+	b, _ := r.take(i + 1)
+	r.add(name, string(b[:i]))
+}
+
+// sdkTimeFormat is the layout of sdk.FormatTimeBytes, which queue keys use.
+const sdkTimeFormat = "2006-01-02T15:04:05.000000000"
+
+func (r *keyReader) time(name string) {
+	if !r.ok || len(r.rest) < len(sdkTimeFormat) {
+		r.ok = false
+		return
+	}
+	t, err := time.Parse(sdkTimeFormat, string(r.rest[:len(sdkTimeFormat)]))
+	if err != nil {
+		r.ok = false
+		return
+	}
+	r.take(len(sdkTimeFormat))
+	r.add(name, t.UTC().Format(time.RFC3339Nano))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+)
+
+func TestDecodeStoreKey(t *testing.T) {
+	// An address whose first byte equals the length of the rest, which a
+	// length-prefix heuristic would misread.
+	addr := bytes.Repeat([]byte{0xab}, 20)
+	addr[0] = 19
+	account, err := bech32.EncodeFromBase256("cosmos", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cons, err := bech32.EncodeFromBase256("cosmosvalcons", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengthPrefixed := append([]byte{20}, addr...)
+
+	// collections.Int64Key: big-endian with the sign bit flipped.
+	int64Key := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v^1<<63) }
+	le := binary.LittleEndian.AppendUint64(nil, 7)
+
+	tests := []struct {
+		name   string
+		store  string
+		key    []byte
+		prefix string
+		fields []KeyField
+	}{
+		{
+			name:   "auth account",
+			store:  "acc",
+			key:    append([]byte{0x01}, addr...),
+			prefix: "account",
+			fields: []KeyField{{"address", account}},
+		},
+		{
+			name:   "missed block index (v0.47 little-endian)",
+			store:  "slashing",
+			key:    append(append([]byte{0x02}, lengthPrefixed...), le...),
+			prefix: "validator_missed_block_bitmap",
+			fields: []KeyField{{"cons_address", cons}, {"index", "7"}},
+		},
+		{
+			name:   "missed block chunk (v0.50 Int64Key)",
+			store:  "slashing",
+			key:    append(append([]byte{0x02}, lengthPrefixed...), int64Key(7)...),
+			prefix: "validator_missed_block_bitmap",
+			fields: []KeyField{{"cons_address", cons}, {"index", "7"}},
+		},
+		{
+			name:   "historical info (v0.47 decimal)",
+			store:  "staking",
+			key:    append([]byte{0x50}, "1234567"...),
+			prefix: "historical_info",
+			fields: []KeyField{{"height", "1234567"}},
+		},
+		{
+			name:   "historical info (v0.50 Int64Key)",
+			store:  "staking",
+			key:    append([]byte{0x50}, int64Key(1234567)...),
+			prefix: "historical_info",
+			fields: []KeyField{{"height", "1234567"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeStoreKey(chainCosmos, tt.store, tt.key, "")
+			if got == nil {
+				t.Fatal("key not decoded")
+			}
+			if got.Prefix != tt.prefix {
+				t.Errorf("prefix = %q, want %q", got.Prefix, tt.prefix)
+			}
+			if len(got.Fields) != len(tt.fields) {
+				t.Fatalf("fields = %v, want %v", got.Fields, tt.fields)
+			}
+			for i := range tt.fields {
+				if got.Fields[i] != tt.fields[i] {
+					t.Errorf("field %d = %v, want %v", i, got.Fields[i], tt.fields[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Error types reported in CompareResponse.ErrorType, so clients can tell a
+// rejected archive from a transient failure.
+const (
+	ErrorTypeArchiveLimit     = "archive_limit"
+	ErrorTypeChecksumMismatch = "checksum_mismatch"
+	ErrorTypeInsufficientDisk = "insufficient_disk"
+	ErrorTypeSourceRejected   = "source_rejected"
+	ErrorTypeInvalidInput     = "invalid_input"
+	ErrorTypeInternal         = "internal"
+)
+
+// archiveLimitError is an archive that was refused because it exceeds one of
+// the extraction limits or contains an entry that is never extracted
+// (symlinks, devices, ...).
+type archiveLimitError struct {
+	Reason string
+}
+
+func (e *archiveLimitError) Error() string {
+	return "archive rejected: " + e.Reason
+}
+
+func limitf(format string, args ...any) error {
+	return &archiveLimitError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// errorType classifies err for CompareResponse.ErrorType; it is empty for
+// errors without a dedicated type.
+func errorType(err error) string {
+	var limitErr *archiveLimitError
+	var mismatch *checksumMismatchError
+	var diskErr *insufficientDiskError
+	var rejected *sourceRejectedError
+	var noShared *noSharedHeightsError
+	switch {
+	case errors.As(err, &limitErr):
+		return ErrorTypeArchiveLimit
+	case errors.As(err, &mismatch):
+		return ErrorTypeChecksumMismatch
+	case errors.As(err, &diskErr):
+		return ErrorTypeInsufficientDisk
+	case errors.As(err, &rejected):
+		return ErrorTypeSourceRejected
+	case errors.As(err, &noShared):
+		return ErrorTypeInvalidInput
+	}
+	return ""
+}
+
+// failureStatus is the HTTP status of a failed comparison: a rejected or
+// corrupt archive, or sources that can't be bisected, are the client's input
+// (422); a source the policy refuses once it is fetched (a redirect or a DNS
+// answer) is 403 like one refused up front; inputs that don't fit on disk are
+// 507; anything else is a server error.
+func failureStatus(response CompareResponse) int {
+	switch response.ErrorType {
+	case ErrorTypeArchiveLimit, ErrorTypeChecksumMismatch, ErrorTypeInvalidInput:
+		return http.StatusUnprocessableEntity
+	case ErrorTypeSourceRejected:
+		return http.StatusForbidden
+	case ErrorTypeInsufficientDisk:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// extractLimits bounds what extracting a single archive may write. Zero
+// disables a limit.
+type extractLimits struct {
+	maxBytes   int64
+	maxEntries int
+	// maxRatio is checked per entry for zip files and over the whole
+	// decompressed stream for tar files, whose compression is not per entry.
+	maxRatio float64
+	// minFreeDisk is the space that must stay free on the destination
+	// filesystem after each file is written.
+	minFreeDisk int64
+}
+
+var archiveLimits = extractLimits{
+	maxBytes:    1 << 40,
+	maxEntries:  1_000_000,
+	maxRatio:    200,
+	minFreeDisk: 1 << 30,
+}
+
+// ratioCheckMinBytes keeps the ratio check away from small files, which
+// legitimately compress far better than the data they sit next to.
+const ratioCheckMinBytes = 1 << 20
+
+// extractBudget tracks one extraction against archiveLimits.
+type extractBudget struct {
+	limits  extractLimits
+	destDir string
+	entries int
+	written int64
+	// compressed returns the compressed bytes consumed so far, for the
+	// stream ratio check of tar archives. It is nil for zip files.
+	compressed func() int64
+}
+
+func newExtractBudget(destDir string) *extractBudget {
+	return &extractBudget{limits: archiveLimits, destDir: destDir}
+}
+
+// checkTotal rejects an archive whose declared contents are already over the
+// limits, before anything is written.
+func (b *extractBudget) checkTotal(entries int, size int64) error {
+	if b.limits.maxEntries > 0 && entries > b.limits.maxEntries {
+		return limitf("%d entries exceed the limit of %d", entries, b.limits.maxEntries)
+	}
+	if b.limits.maxBytes > 0 && size > b.limits.maxBytes {
+		return limitf("%d uncompressed bytes exceed the limit of %d", size, b.limits.maxBytes)
+	}
+	return b.checkDisk("the archive", size)
+}
+
+// addEntry accounts for the next entry, of size bytes, before it is written.
+func (b *extractBudget) addEntry(name string, size int64) error {
+	b.entries++
+	if b.limits.maxEntries > 0 && b.entries > b.limits.maxEntries {
+		return limitf("more than %d entries", b.limits.maxEntries)
+	}
+	if b.limits.maxBytes > 0 && b.written+size > b.limits.maxBytes {
+		return limitf("%s would take the extracted size past the limit of %d bytes", name, b.limits.maxBytes)
+	}
+	if size == 0 {
+		return nil
+	}
+	return b.checkDisk(name, size)
+}
+
+func (b *extractBudget) checkDisk(name string, size int64) error {
+	if b.limits.minFreeDisk <= 0 {
+		return nil
+	}
+	free, ok := diskFree(b.destDir)
+	if ok && free-size < b.limits.minFreeDisk {
+		return limitf("extracting %s needs %d bytes, but only %d are free and %d must stay free", name, size, free, b.limits.minFreeDisk)
+	}
+	return nil
+}
+
+// checkEntryRatio rejects a zip entry that expands suspiciously well.
+func (b *extractBudget) checkEntryRatio(name string, size, compressedSize int64) error {
+	if b.limits.maxRatio <= 0 || size < ratioCheckMinBytes {
+		return nil
+	}
+	if ratio := float64(size) / float64(max(compressedSize, 1)); ratio > b.limits.maxRatio {
+		return limitf("%s has a compression ratio of %.0f, over the limit of %.0f", name, ratio, b.limits.maxRatio)
+	}
+	return nil
+}
+
+// writer counts what is written through it and, for streams, stops once the
+// output outgrows the compressed input by more than maxRatio.
+func (b *extractBudget) writer(w io.Writer) io.Writer {
+	return &budgetWriter{w: w, b: b}
+}
+
+type budgetWriter struct {
+	w io.Writer
+	b *extractBudget
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	b := w.b
+	b.written += int64(n)
+	if err == nil && b.compressed != nil && b.limits.maxRatio > 0 && b.written >= ratioCheckMinBytes {
+		if ratio := float64(b.written) / float64(max(b.compressed(), 1)); ratio > b.limits.maxRatio {
+			err = limitf("the archive has a compression ratio of %.0f, over the limit of %.0f", ratio, b.limits.maxRatio)
+		}
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
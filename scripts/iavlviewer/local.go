@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cosmossdk.io/log"
+	"cosmossdk.io/store"
+	"cosmossdk.io/store/metrics"
+	"cosmossdk.io/store/rootmulti"
+	dbm "github.com/cosmos/cosmos-db"
+)
+
+// newMultiStore wraps an opened application DB. For read-only sources the
+// IAVL fast-node index is disabled, since loading a version would otherwise
+// try to build it and write to the DB.
+func newMultiStore(db dbm.DB, source *DataSource) *rootmulti.Store {
+	ms := store.NewCommitMultiStore(db, log.NewNopLogger(), metrics.NewNoOpMetrics()).(*rootmulti.Store)
+	if source.ReadOnly {
+		ms.SetIAVLDisableFastNode(true)
+	}
+	return ms
+}
+
+// openLocalInPlace uses a local data directory without copying it. The DB is
+// opened read-only, which goleveldb supports natively.
+func openLocalInPlace(req DataSourceRequest) (*DataSource, error) {
+	dir, backend, err := checkLocalSource(req)
+	if err != nil {
+		return nil, err
+	}
+	if backend != dbm.GoLevelDBBackend {
+		return nil, fmt.Errorf("%s uses %s, which cannot be opened read-only in place; use mode \"link\" instead", dir, backend)
+	}
+	fmt.Printf("[INFO] Opening %s read-only in place\n", dir)
+	return &DataSource{Path: dir, Backend: string(backend), ReadOnly: true}, nil
+}
+
+// cloneLocalSource prepares a local data directory in targetDir without a full
+// copy. Files are reflinked where the filesystem supports it; otherwise the
+// immutable table files are hardlinked and only the small mutable files (WAL,
+// MANIFEST, CURRENT, ...) are copied, so opening the clone can never change
+// the original.
+func cloneLocalSource(ctx context.Context, req DataSourceRequest, targetDir string) (*DataSource, error) {
+	if _, _, err := checkLocalSource(req); err != nil {
+		return nil, err
+	}
+
+	reflinked, linked, copied, err := cloneDir(ctx, req.Path, targetDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone local dir: %v", err)
+	}
+	finalDir := findDBDir(targetDir)
+	fmt.Printf("[INFO] Cloned %s into %s (%d reflinked, %d hardlinked, %d copied)\n", req.Path, finalDir, reflinked, linked, copied)
+	return &DataSource{Path: finalDir, Backend: req.Backend}, nil
+}
+
+// cloneDir recreates src in dst, reflinking each file where possible and
+// otherwise hardlinking immutable table files and copying the rest.
+func cloneDir(ctx context.Context, src, dst string) (reflinked, linked, copied int, err error) {
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode())
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		if reflink(path, target) == nil {
+			reflinked++
+			return nil
+		}
+		if isImmutableTableFile(path) && os.Link(path, target) == nil {
+			linked++
+			return nil
+		}
+		copied++
+		return copyFile(path, target, info.Mode())
+	})
+	return reflinked, linked, copied, err
+}
+
+// checkLocalSource resolves the data directory of a local source and its
+// backend, and refuses it while a running node holds the DB lock: its files
+// are changing underneath us and goleveldb would not open them anyway.
+func checkLocalSource(req DataSourceRequest) (string, dbm.BackendType, error) {
+	dir := findDBDir(req.Path)
+	appDB := filepath.Join(dir, "application.db")
+	if info, err := os.Stat(appDB); err != nil || !info.IsDir() {
+		return "", "", fmt.Errorf("no application.db found in %s", dir)
+	}
+	backend := dbm.BackendType(req.Backend)
+	if backend == "" {
+		detected, err := detectBackend(appDB)
+		if err != nil {
+			return "", "", err
+		}
+		backend = detected
+	}
+	locked, err := dbLocked(appDB, backend)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check the lock of %s: %v", appDB, err)
+	}
+	if locked {
+		return "", "", fmt.Errorf("%s is locked by another process, probably a running node; stop it first or compare a copy", appDB)
+	}
+	return dir, backend, nil
+}
+
+// isImmutableTableFile reports whether a DB file is never modified after it
+// is written: LevelDB/Pebble/RocksDB tables and blob files.
+func isImmutableTableFile(path string) bool {
+	for _, ext := range []string{".ldb", ".sst", ".blob"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
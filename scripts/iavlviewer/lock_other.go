@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import dbm "github.com/cosmos/cosmos-db"
+
+// dbLocked cannot probe file locks on this platform; opening a DB that a
+// running node holds still fails for goleveldb.
+func dbLocked(dbDir string, backend dbm.BackendType) (bool, error) {
+	return false, nil
+}
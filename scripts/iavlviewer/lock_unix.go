@@ -0,0 +1,44 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	dbm "github.com/cosmos/cosmos-db"
+	"golang.org/x/sys/unix"
+)
+
+// dbLocked reports whether another process holds the LOCK file of dbDir.
+// goleveldb locks it with flock, Pebble and RocksDB with fcntl record locks,
+// and the two kinds don't see each other, so probe the one the backend uses.
+func dbLocked(dbDir string, backend dbm.BackendType) (bool, error) {
+	f, err := os.Open(filepath.Join(dbDir, "LOCK"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if backend == dbm.GoLevelDBBackend {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return false, unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	}
+
+	// F_GETLK only asks who would conflict, so nothing needs releasing.
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0}
+	if err := unix.FcntlFlock(f.Fd(), unix.F_GETLK, &lk); err != nil {
+		return false, err
+	}
+	return lk.Type != unix.F_UNLCK, nil
+}
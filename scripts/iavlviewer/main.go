@@ -3,26 +3,25 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"cosmossdk.io/log"
-	"cosmossdk.io/store"
-	"cosmossdk.io/store/metrics"
 	"cosmossdk.io/store/rootmulti"
 	storetypes "cosmossdk.io/store/types"
 	dbm "github.com/cosmos/cosmos-db"
-	"github.com/cosmos/iavl"
 )
 
 // Request/Response structures for API
@@ -30,28 +29,75 @@ type CompareRequest struct {
 	Source1 DataSourceRequest `json:"source1"`
 	Source2 DataSourceRequest `json:"source2"`
 	Options CompareOptions    `json:"options,omitempty"`
+	// Async makes POST /compare return a job right away instead of waiting
+	// for the result; poll /jobs/{id} and fetch /jobs/{id}/result.
+	Async bool `json:"async,omitempty"`
+	// Owner is the client the comparison runs for; see requestOwner.
+	Owner string `json:"-"`
 }
 
 type DataSourceRequest struct {
-	Type string `json:"type"` // "local", "zip_file", "zip_url", "upload"
+	// Type is "local", "archive_file", "archive_url" or "upload". Archives may
+	// be zip, tar, tar.gz, tar.lz4 or tar.zst and are recognized by content;
+	// "zip_file" and "zip_url" are accepted as aliases.
+	Type string `json:"type"`
 	Path string `json:"path,omitempty"`
 	URL  string `json:"url,omitempty"`
 	Data []byte `json:"data,omitempty"` // For file uploads
 	Name string `json:"name,omitempty"` // Original filename for uploads
+	// UploadID refers to an archive sent to POST /uploads, instead of
+	// inlining it in Data.
+	UploadID string `json:"upload_id,omitempty"`
+	// Version selects the height to load from this source. Zero falls back to
+	// CompareOptions.Height and then to the latest committed version.
+	Version int64 `json:"version,omitempty"`
+	// Backend names the cosmos-db backend of application.db ("goleveldb",
+	// "pebbledb", "rocksdb"). Empty means detect it from the files on disk.
+	Backend string `json:"backend,omitempty"`
+	// Mode controls how a "local" source is prepared: "copy" (default) copies
+	// it into the task directory, "readonly" opens it in place without write
+	// access (goleveldb only), and "link" builds a reflink/hardlink clone.
+	Mode string `json:"mode,omitempty"`
+	// SHA256 is the expected hex checksum of an archive source. The archive
+	// is verified before extraction and the comparison fails on a mismatch.
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 type CompareOptions struct {
 	MaxDiffsPerStore   int  `json:"max_diffs_per_store,omitempty"`
 	ShowMatchingStores bool `json:"show_matching_stores,omitempty"`
 	DetailedOutput     bool `json:"detailed_output,omitempty"`
+	// Height compares both sources at the same version unless a source sets
+	// its own Version.
+	Height int64 `json:"height,omitempty"`
+	// Bisect searches the commit infos of both sources for the first height
+	// where any store hash differs and compares the stores at that height.
+	Bisect bool `json:"bisect,omitempty"`
+	// Bech32Prefix is the account address prefix of the chain, used to render
+	// addresses in decoded keys ("cosmos" by default).
+	Bech32Prefix string `json:"bech32_prefix,omitempty"`
+	// Chain selects the store layouts keys and values are decoded with:
+	// "cosmos" or "heimdall". It is detected from the store names when empty.
+	Chain string `json:"chain,omitempty"`
+	// ProtoDescriptors is a FileDescriptorSet file or a directory of .proto
+	// files to decode values with; ProtoDescriptorSet inlines a set instead.
+	ProtoDescriptors   string `json:"proto_descriptors,omitempty"`
+	ProtoDescriptorSet []byte `json:"proto_descriptor_set,omitempty"`
+	// ProtoTypes maps "store", "store/<key prefix hex>" or
+	// "store/<decoded key prefix>" to the full name of the message stored
+	// there, e.g. "staking/validator": "cosmos.staking.v1beta1.Validator".
+	ProtoTypes map[string]string `json:"proto_types,omitempty"`
 }
 
 type CompareResponse struct {
-	Success  bool              `json:"success"`
-	Error    string            `json:"error,omitempty"`
-	Summary  ComparisonSummary `json:"summary"`
-	Results  []StoreComparison `json:"results"`
-	Metadata ResponseMetadata  `json:"metadata"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	// ErrorType classifies some failures (one of the ErrorType* constants).
+	ErrorType string            `json:"error_type,omitempty"`
+	Summary   ComparisonSummary `json:"summary"`
+	Results   []StoreComparison `json:"results"`
+	Bisect    *BisectResult     `json:"bisect,omitempty"`
+	Metadata  ResponseMetadata  `json:"metadata"`
 }
 
 type ComparisonSummary struct {
@@ -63,26 +109,51 @@ type ComparisonSummary struct {
 }
 
 type StoreComparison struct {
-	Name        string            `json:"name"`
-	Status      string            `json:"status"` // "match", "differ", "missing_source1", "missing_source2"
-	Hash1       string            `json:"hash1,omitempty"`
-	Hash2       string            `json:"hash2,omitempty"`
-	StoreType1  string            `json:"store_type1,omitempty"`
-	StoreType2  string            `json:"store_type2,omitempty"`
-	Differences []StoreDifference `json:"differences,omitempty"`
-	SampleData  *StoreSampleData  `json:"sample_data,omitempty"`
-	Extra       string            `json:"extra,omitempty"`
+	Name             string            `json:"name"`
+	Status           string            `json:"status"` // "match", "differ", "missing_source1", "missing_source2"
+	Hash1            string            `json:"hash1,omitempty"`
+	Hash2            string            `json:"hash2,omitempty"`
+	StoreType1       string            `json:"store_type1,omitempty"`
+	StoreType2       string            `json:"store_type2,omitempty"`
+	Differences      []StoreDifference `json:"differences,omitempty"`
+	DifferenceCounts *DifferenceCounts `json:"difference_counts,omitempty"`
+	SampleData       *StoreSampleData  `json:"sample_data,omitempty"`
+	Extra            string            `json:"extra,omitempty"`
+}
+
+// DifferenceCounts tallies every difference in a store, including the ones
+// left out of StoreComparison.Differences by MaxDiffsPerStore.
+type DifferenceCounts struct {
+	Total          int `json:"total"`
+	KeyOnlySource1 int `json:"key_only_source1"`
+	KeyOnlySource2 int `json:"key_only_source2"`
+	ValueDiffer    int `json:"value_differ"`
+	// ByPrefix counts differences by the hex of the key's first byte, which is
+	// the module prefix for standard Cosmos SDK stores.
+	ByPrefix map[string]int `json:"by_prefix,omitempty"`
 }
 
 type StoreDifference struct {
-	Type        string `json:"type"` // "key_only_source1", "key_only_source2", "value_differ"
-	Key         string `json:"key"`
-	KeyHex      string `json:"key_hex"`
-	Value1      string `json:"value1,omitempty"`
-	Value1Hex   string `json:"value1_hex,omitempty"`
-	Value2      string `json:"value2,omitempty"`
-	Value2Hex   string `json:"value2_hex,omitempty"`
-	Description string `json:"description"`
+	Type   string `json:"type"` // "key_only_source1", "key_only_source2", "value_differ"
+	Key    string `json:"key"`
+	KeyHex string `json:"key_hex"`
+	// DecodedKey is set for keys of stores with a registered key decoder.
+	DecodedKey *DecodedKey `json:"decoded_key,omitempty"`
+	Value1     string      `json:"value1,omitempty"`
+	Value1Hex  string      `json:"value1_hex,omitempty"`
+	Value2     string      `json:"value2,omitempty"`
+	Value2Hex  string      `json:"value2_hex,omitempty"`
+	// ValueType is how the values were decoded: the protobuf message given by
+	// CompareOptions.ProtoTypes, the type a --decoder plugin names (or
+	// "plugin"), "json", "amino_json" for the params store, or the Heimdall
+	// type, e.g. "heimdall.Checkpoint". Value1Decoded and Value2Decoded hold
+	// the values as JSON and FieldChanges lists the fields that differ.
+	ValueType     string          `json:"value_type,omitempty"`
+	Value1Decoded json.RawMessage `json:"value1_decoded,omitempty"`
+	Value2Decoded json.RawMessage `json:"value2_decoded,omitempty"`
+	FieldChanges  []FieldChange   `json:"field_changes,omitempty"`
+	DecodeError   string          `json:"decode_error,omitempty"`
+	Description   string          `json:"description"`
 }
 
 type StoreSampleData struct {
@@ -97,27 +168,51 @@ type SampleKey struct {
 }
 
 type ResponseMetadata struct {
-	Source1Version int64  `json:"source1_version"`
-	Source2Version int64  `json:"source2_version"`
-	ComparisonTime string `json:"comparison_time"`
-	ProcessingTime string `json:"processing_time"`
+	Source1Version           int64          `json:"source1_version"`
+	Source2Version           int64          `json:"source2_version"`
+	Source1AvailableVersions []VersionRange `json:"source1_available_versions,omitempty"`
+	Source2AvailableVersions []VersionRange `json:"source2_available_versions,omitempty"`
+	Source1Backend           string         `json:"source1_backend,omitempty"`
+	Source2Backend           string         `json:"source2_backend,omitempty"`
+	ComparisonTime           string         `json:"comparison_time"`
+	ProcessingTime           string         `json:"processing_time"`
+	// Chain is the chain whose store layouts decoded the differences.
+	Chain string `json:"chain,omitempty"`
+	// ComparisonID identifies a stored comparison for GET /comparisons/{id}
+	// and, while its sources are retained, GET /comparisons/{id}/differences.
+	ComparisonID string `json:"comparison_id,omitempty"`
+}
+
+// VersionRange is an inclusive run of consecutive heights retained in a DB.
+type VersionRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
 }
 
 type DataSource struct {
-	Path   string
-	IsTemp bool
+	Path    string
+	IsTemp  bool
+	Backend string
+	// ReadOnly marks a source opened in place; it must never be written to.
+	ReadOnly bool
+	// cached is the cache entry the source is read from, held until the
+	// comparison and its retention are over.
+	cached *cacheEntry
 }
 
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Usage:")
-		fmt.Println("  CLI mode: compare_stores <source1> <source2> [--json]")
-		fmt.Println("  Web API mode: compare_stores --server [--port=8080]")
+		fmt.Println("  CLI mode: compare_stores <source1> <source2> [--json] [--height=H] [--version1=H1] [--version2=H2] [--bisect] [--backend1=B1] [--backend2=B2] [--bech32-prefix=cosmos] [--chain=cosmos|heimdall] [--proto=FILE|DIR --proto-type=STORE[/PREFIX]=MESSAGE ...] [--decoder=STORE=COMMAND ...]")
+		fmt.Println("  Web API mode: compare_stores --server [--port=8080] [--auth-config=auth.json] [--cors-origins=*] [--retain=30m] [--max-runtime=2h] [--workers=2] [--max-queued-per-client=10] [--data-dir=data] [--allow-local-root=DIR,...] [--allowed-url-schemes=http,https] [--allowed-url-hosts=HOST,...] [--allow-private-urls] [--upload-retain=24h] [--max-extract-size=1T] [--max-extract-entries=1000000] [--max-compression-ratio=200] [--min-free-disk=1G] [--download-retries=5] [--cache-dir=cache] [--cache-max-size=50G] [--cache-max-age=168h] [--decoder=STORE=COMMAND ...]")
 		fmt.Println()
 		fmt.Println("Sources can be:")
 		fmt.Println("  - Local directory path")
-		fmt.Println("  - ZIP file path")
-		fmt.Println("  - HTTP/HTTPS URL to ZIP file")
+		fmt.Println("  - Archive file path (.zip, .tar, .tar.gz, .tar.lz4, .tar.zst)")
+		fmt.Println("  - HTTP/HTTPS URL to an archive")
+		fmt.Println()
+		fmt.Println("Heights default to the latest committed version of each source.")
+		fmt.Println("Backends (goleveldb, pebbledb, rocksdb) are detected from disk unless given.")
 		os.Exit(1)
 	}
 
@@ -132,25 +227,318 @@ func main() {
 		os.Exit(1)
 	}
 
-	jsonOutput := len(os.Args) > 3 && os.Args[3] == "--json"
-	runCLIComparison(os.Args[1], os.Args[2], jsonOutput)
+	flags, err := parseCLIFlags(os.Args[3:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	runCLIComparison(os.Args[1], os.Args[2], flags)
+}
+
+type cliFlags struct {
+	JSONOutput bool
+	Height     int64
+	Version1   int64
+	Version2   int64
+	Bisect     bool
+	Backend1   string
+	Backend2   string
+	// Bech32Prefix overrides the address prefix used in decoded keys.
+	Bech32Prefix string
+	Proto        string
+	ProtoTypes   map[string]string
+	// Chain overrides the detected store layouts.
+	Chain string
+}
+
+func parseCLIFlags(args []string) (cliFlags, error) {
+	var flags cliFlags
+	for _, arg := range args {
+		var err error
+		switch {
+		case arg == "--json":
+			flags.JSONOutput = true
+		case arg == "--bisect":
+			flags.Bisect = true
+		case strings.HasPrefix(arg, "--height="):
+			flags.Height, err = strconv.ParseInt(strings.TrimPrefix(arg, "--height="), 10, 64)
+		case strings.HasPrefix(arg, "--version1="):
+			flags.Version1, err = strconv.ParseInt(strings.TrimPrefix(arg, "--version1="), 10, 64)
+		case strings.HasPrefix(arg, "--version2="):
+			flags.Version2, err = strconv.ParseInt(strings.TrimPrefix(arg, "--version2="), 10, 64)
+		case strings.HasPrefix(arg, "--backend1="):
+			flags.Backend1 = strings.TrimPrefix(arg, "--backend1=")
+		case strings.HasPrefix(arg, "--backend2="):
+			flags.Backend2 = strings.TrimPrefix(arg, "--backend2=")
+		case strings.HasPrefix(arg, "--bech32-prefix="):
+			flags.Bech32Prefix = strings.TrimPrefix(arg, "--bech32-prefix=")
+		case strings.HasPrefix(arg, "--chain="):
+			flags.Chain = strings.TrimPrefix(arg, "--chain=")
+		case strings.HasPrefix(arg, "--proto="):
+			flags.Proto = strings.TrimPrefix(arg, "--proto=")
+		case strings.HasPrefix(arg, "--proto-type="):
+			pattern, message, ok := strings.Cut(strings.TrimPrefix(arg, "--proto-type="), "=")
+			if !ok {
+				return flags, fmt.Errorf("invalid value for %s: expected store[/prefix]=message", arg)
+			}
+			if flags.ProtoTypes == nil {
+				flags.ProtoTypes = map[string]string{}
+			}
+			flags.ProtoTypes[pattern] = message
+		case strings.HasPrefix(arg, "--decoder="):
+			err = addDecoderPlugin(strings.TrimPrefix(arg, "--decoder="))
+		default:
+			return flags, fmt.Errorf("unknown flag: %s", arg)
+		}
+		if err != nil {
+			return flags, fmt.Errorf("invalid value for %s: %v", arg, err)
+		}
+	}
+	return flags, nil
 }
 
 func startWebServer() {
 	port := "8080"
+	sourceRetention = 30 * time.Minute
+	maxJobRuntime = 2 * time.Hour
+	dataDir := "data"
+	cacheDir := "cache"
+	authConfig := ""
+	var origins []string
+	originsSet := false
+	var localRoots, urlHosts []string
+	urlSchemes := []string{"http", "https"}
+	allowPrivateURLs := false
+	cacheMaxSize := int64(50 << 30)
+	cacheMaxAge := 7 * 24 * time.Hour
 	for _, arg := range os.Args {
 		if strings.HasPrefix(arg, "--port=") {
 			port = strings.TrimPrefix(arg, "--port=")
 		}
+		if strings.HasPrefix(arg, "--retain=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "--retain="))
+			if err != nil {
+				fmt.Printf("Invalid --retain duration: %v\n", err)
+				os.Exit(1)
+			}
+			sourceRetention = d
+		}
+		if strings.HasPrefix(arg, "--max-runtime=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "--max-runtime="))
+			if err != nil {
+				fmt.Printf("Invalid --max-runtime duration: %v\n", err)
+				os.Exit(1)
+			}
+			maxJobRuntime = d
+		}
+		if strings.HasPrefix(arg, "--workers=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--workers="))
+			if err != nil || n < 1 {
+				fmt.Printf("Invalid --workers: must be a positive integer\n")
+				os.Exit(1)
+			}
+			comparisonQueue.workers = n
+		}
+		if strings.HasPrefix(arg, "--max-queued-per-client=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--max-queued-per-client="))
+			if err != nil || n < 0 {
+				fmt.Printf("Invalid --max-queued-per-client: must be a non-negative integer\n")
+				os.Exit(1)
+			}
+			comparisonQueue.maxPerClient = n
+		}
+		if strings.HasPrefix(arg, "--download-retries=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--download-retries="))
+			if err != nil || n < 0 {
+				fmt.Printf("Invalid --download-retries: must be a non-negative integer\n")
+				os.Exit(1)
+			}
+			downloadRetries = n
+		}
+		if strings.HasPrefix(arg, "--data-dir=") {
+			dataDir = strings.TrimPrefix(arg, "--data-dir=")
+		}
+		if strings.HasPrefix(arg, "--auth-config=") {
+			authConfig = strings.TrimPrefix(arg, "--auth-config=")
+		}
+		if strings.HasPrefix(arg, "--cors-origins=") {
+			origins = splitList(strings.TrimPrefix(arg, "--cors-origins="))
+			originsSet = true
+		}
+		if strings.HasPrefix(arg, "--allow-local-root=") {
+			localRoots = append(localRoots, splitList(strings.TrimPrefix(arg, "--allow-local-root="))...)
+		}
+		if strings.HasPrefix(arg, "--allowed-url-schemes=") {
+			urlSchemes = splitList(strings.TrimPrefix(arg, "--allowed-url-schemes="))
+		}
+		if strings.HasPrefix(arg, "--allowed-url-hosts=") {
+			urlHosts = splitList(strings.TrimPrefix(arg, "--allowed-url-hosts="))
+		}
+		if arg == "--allow-private-urls" {
+			allowPrivateURLs = true
+		}
+		if strings.HasPrefix(arg, "--max-extract-size=") {
+			n, err := parseByteSize(strings.TrimPrefix(arg, "--max-extract-size="))
+			if err != nil {
+				fmt.Printf("Invalid --max-extract-size: %v\n", err)
+				os.Exit(1)
+			}
+			archiveLimits.maxBytes = n
+		}
+		if strings.HasPrefix(arg, "--max-extract-entries=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--max-extract-entries="))
+			if err != nil || n < 0 {
+				fmt.Printf("Invalid --max-extract-entries: must be a non-negative integer\n")
+				os.Exit(1)
+			}
+			archiveLimits.maxEntries = n
+		}
+		if strings.HasPrefix(arg, "--max-compression-ratio=") {
+			f, err := strconv.ParseFloat(strings.TrimPrefix(arg, "--max-compression-ratio="), 64)
+			if err != nil || f < 0 {
+				fmt.Printf("Invalid --max-compression-ratio: must be a non-negative number\n")
+				os.Exit(1)
+			}
+			archiveLimits.maxRatio = f
+		}
+		if strings.HasPrefix(arg, "--min-free-disk=") {
+			n, err := parseByteSize(strings.TrimPrefix(arg, "--min-free-disk="))
+			if err != nil {
+				fmt.Printf("Invalid --min-free-disk: %v\n", err)
+				os.Exit(1)
+			}
+			archiveLimits.minFreeDisk = n
+		}
+		if strings.HasPrefix(arg, "--upload-retain=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "--upload-retain="))
+			if err != nil {
+				fmt.Printf("Invalid --upload-retain duration: %v\n", err)
+				os.Exit(1)
+			}
+			uploadRetention = d
+		}
+		if strings.HasPrefix(arg, "--decoder=") {
+			if err := addDecoderPlugin(strings.TrimPrefix(arg, "--decoder=")); err != nil {
+				fmt.Printf("Invalid --decoder: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if strings.HasPrefix(arg, "--cache-dir=") {
+			cacheDir = strings.TrimPrefix(arg, "--cache-dir=")
+		}
+		if strings.HasPrefix(arg, "--cache-max-size=") {
+			n, err := parseByteSize(strings.TrimPrefix(arg, "--cache-max-size="))
+			if err != nil {
+				fmt.Printf("Invalid --cache-max-size: %v\n", err)
+				os.Exit(1)
+			}
+			cacheMaxSize = n
+		}
+		if strings.HasPrefix(arg, "--cache-max-age=") {
+			d, err := time.ParseDuration(strings.TrimPrefix(arg, "--cache-max-age="))
+			if err != nil {
+				fmt.Printf("Invalid --cache-max-age duration: %v\n", err)
+				os.Exit(1)
+			}
+			cacheMaxAge = d
+		}
+	}
+
+	if authConfig != "" {
+		if err := loadAuthConfig(authConfig); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
+	// An authenticated API is same-origin only unless origins are listed.
+	switch {
+	case originsSet:
+		corsOrigins = origins
+	case authTokens != nil:
+		corsOrigins = nil
+	}
+	p, err := newSourcePolicy(localRoots, urlSchemes, urlHosts, allowPrivateURLs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	policy = p
+	sourceHTTPClient = p.newSourceHTTPClient()
 
-	http.HandleFunc("/compare", handleCompareAPI)
+	if err := openHistory(dataDir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	comparisonQueue.dir = dataDir
+	if err := openUploads(filepath.Join(dataDir, "uploads")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := openDownloads(filepath.Join(dataDir, "downloads")); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if cacheDir != "" {
+		if err := openSourceCache(cacheDir, cacheMaxSize, cacheMaxAge); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		go pruneSourceCache(time.Minute)
+	}
+
+	http.HandleFunc("/compare", requireAuth(handleCompareAPI))
+	http.HandleFunc("/comparisons", requireAuth(handleComparisonsAPI))
+	http.HandleFunc("/comparisons/{id}", requireAuth(handleComparisonAPI))
+	http.HandleFunc("/comparisons/{id}/differences", requireAuth(handleDifferencesAPI))
+	http.HandleFunc("/uploads", requireAuth(handleUploadsAPI))
+	http.HandleFunc("/uploads/{id}", requireAuth(handleUploadAPI))
+	http.HandleFunc("/jobs/{id}", requireAuth(handleJobStatusAPI))
+	http.HandleFunc("/jobs/{id}/result", requireAuth(handleJobResultAPI))
+	http.HandleFunc("/jobs/{id}/events", requireAuthOrEventsToken(handleJobEventsAPI))
 	http.HandleFunc("/health", handleHealth)
+	go pruneRetainedComparisons(time.Minute)
+	go pruneJobs(time.Hour)
+	go pruneUploads(time.Hour)
+	go pruneDownloads(time.Hour)
 
 	fmt.Printf("Starting store comparison API server on port %s\n", port)
 	fmt.Printf("Endpoints:\n")
-	fmt.Printf("  POST /compare - Compare two data sources\n")
-	fmt.Printf("  GET  /health  - Health check\n")
+	fmt.Printf("  POST /compare                        - Compare two data sources (\"async\": true returns a job)\n")
+	fmt.Printf("  GET  /comparisons                    - List stored comparisons (?from=&to=&identical=&source=&cursor=&limit=)\n")
+	fmt.Printf("  GET  /comparisons/{id}               - Stored comparison report\n")
+	fmt.Printf("  GET  /comparisons/{id}/differences   - Page through a store's differences (?store=&cursor=&limit=)\n")
+	fmt.Printf("  POST /uploads                        - Upload an archive (multipart/form-data, or JSON to start a resumable upload)\n")
+	fmt.Printf("  GET  /uploads/{id}                   - Upload status and offset (PUT appends a chunk, DELETE removes it)\n")
+	fmt.Printf("  GET  /jobs/{id}                      - Status of an async comparison (DELETE cancels it)\n")
+	fmt.Printf("  GET  /jobs/{id}/result               - Result of an async comparison once done\n")
+	fmt.Printf("  GET  /jobs/{id}/events               - Live progress of an async comparison (Server-Sent Events)\n")
+	fmt.Printf("  GET  /health                         - Health check\n")
+	fmt.Printf("Comparison history is stored in %s\n", dataDir)
+	if authTokens == nil {
+		fmt.Printf("Authentication is disabled (use --auth-config)\n")
+	} else {
+		fmt.Printf("%d API tokens loaded from %s\n", len(authTokens), authConfig)
+	}
+	if len(corsOrigins) == 0 {
+		fmt.Printf("Cross-origin browser requests are disabled (use --cors-origins)\n")
+	} else {
+		fmt.Printf("CORS allowed origins: %s\n", strings.Join(corsOrigins, ", "))
+	}
+	if len(localRoots) == 0 {
+		fmt.Printf("Local path sources are disabled (use --allow-local-root)\n")
+	} else {
+		fmt.Printf("Local path sources are allowed below %s\n", strings.Join(localRoots, ", "))
+	}
+	if !allowPrivateURLs {
+		fmt.Printf("URL sources may not reach private or link-local addresses (use --allow-private-urls)\n")
+	}
+	if cacheDir != "" {
+		fmt.Printf("Prepared archive sources are cached in %s (max size %d bytes, max age %s; 0 is unlimited)\n", cacheDir, cacheMaxSize, cacheMaxAge)
+	}
+	fmt.Printf("Prepared sources are kept for %s after a comparison for paging\n", sourceRetention)
+	if maxJobRuntime > 0 {
+		fmt.Printf("Comparisons are stopped after %s\n", maxJobRuntime)
+	}
 
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		fmt.Printf("Server failed to start: %v\n", err)
@@ -158,15 +546,8 @@ func startWebServer() {
 	}
 }
 
-// Add CORS helper
-func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-}
-
 func handleHealth(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+	setCORSHeaders(w, r)
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -182,7 +563,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCompareAPI(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
+	setCORSHeaders(w, r)
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -200,11 +581,8 @@ func handleCompareAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Log request body for POST
-	var bodyCopy bytes.Buffer
-	tee := io.TeeReader(r.Body, &bodyCopy)
 	var req CompareRequest
-	if err := json.NewDecoder(tee).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(CompareResponse{
 			Success: false,
@@ -212,66 +590,148 @@ func handleCompareAPI(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	fmt.Printf("[Compare] Request body: %s\n", bodyCopy.String())
+	// Log the sources rather than the body, which may carry a whole archive.
+	fmt.Printf("[Compare] Request: source1=%s (%s) source2=%s (%s)\n",
+		sourceLabel(req.Source1), req.Source1.Type, sourceLabel(req.Source2), req.Source2.Type)
+
+	req.Owner = requestOwner(r)
+	if err := checkUploadOwner(req); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err := policy.checkSources(r.Context(), req); err != nil {
+		fmt.Printf("[Compare] Rejected: %v\n", err)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success:   false,
+			Error:     err.Error(),
+			ErrorType: ErrorTypeSourceRejected,
+		})
+		return
+	}
+	token := requestToken(r)
+	if err := token.checkSources(req); err != nil {
+		fmt.Printf("[Compare] Rejected: %v\n", err)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if _, err := newDifferenceDecoder(req.Options); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid options: %v", err),
+		})
+		return
+	}
+	release, err := token.acquireJobSlot()
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	client := requestClient(r)
+	ticket, err := comparisonQueue.enqueue(client, estimateInputSize(r.Context(), req))
+	if err != nil {
+		release()
+		fmt.Printf("[Compare] Not queued: %v\n", err)
+		w.WriteHeader(queueErrorStatus(err))
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success:   false,
+			Error:     err.Error(),
+			ErrorType: errorType(err),
+		})
+		return
+	}
 
 	// Set default options
 	if req.Options.MaxDiffsPerStore == 0 {
 		req.Options.MaxDiffsPerStore = 5
 	}
 
-	response := performComparison(req)
+	if req.Async {
+		status := startJob(req, ticket, release)
+		fmt.Printf("[Compare] Started job %s for %s\n", status.ID, client)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	// A synchronous comparison waits in the queue as long as the client does.
+	defer release()
+	defer ticket.done()
+	if err := ticket.wait(r.Context()); err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		w.WriteHeader(queueErrorStatus(err))
+		json.NewEncoder(w).Encode(CompareResponse{
+			Success:   false,
+			Error:     err.Error(),
+			ErrorType: errorType(err),
+		})
+		return
+	}
+
+	// The comparison stops when the client goes away or the runtime limit hits.
+	ctx, cancel := comparisonContext(r.Context())
+	defer cancel()
+	response := performComparison(ctx, req)
 
 	if !response.Success {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(failureStatus(response))
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
 
-func runCLIComparison(source1, source2 string, jsonOutput bool) {
+func runCLIComparison(source1, source2 string, flags cliFlags) {
 	req := CompareRequest{
 		Source1: DataSourceRequest{
-			Type: detectSourceType(source1),
-			Path: source1,
-			URL:  source1,
+			Type:    detectSourceType(source1),
+			Path:    source1,
+			URL:     source1,
+			Version: flags.Version1,
+			Backend: flags.Backend1,
 		},
 		Source2: DataSourceRequest{
-			Type: detectSourceType(source2),
-			Path: source2,
-			URL:  source2,
+			Type:    detectSourceType(source2),
+			Path:    source2,
+			URL:     source2,
+			Version: flags.Version2,
+			Backend: flags.Backend2,
 		},
 		Options: CompareOptions{
 			MaxDiffsPerStore:   5,
 			ShowMatchingStores: true,
 			DetailedOutput:     true,
+			Height:             flags.Height,
+			Bisect:             flags.Bisect,
+			Bech32Prefix:       flags.Bech32Prefix,
+			Chain:              flags.Chain,
+			ProtoDescriptors:   flags.Proto,
+			ProtoTypes:         flags.ProtoTypes,
 		},
 	}
 
-	response := performComparison(req)
+	response := performComparison(context.Background(), req)
 
-	if jsonOutput {
+	if flags.JSONOutput {
 		output, _ := json.MarshalIndent(response, "", "  ")
 		fmt.Println(string(output))
 	} else {
-		// Open the DBs and multistores for tree shape diff
-		db1, err1 := dbm.NewDB("application", dbm.GoLevelDBBackend, source1)
-		db2, err2 := dbm.NewDB("application", dbm.GoLevelDBBackend, source2)
-		var ms1, ms2 *rootmulti.Store
-		if err1 == nil && err2 == nil {
-			ms1 = store.NewCommitMultiStore(db1, log.NewNopLogger(), metrics.NewNoOpMetrics()).(*rootmulti.Store)
-			ms2 = store.NewCommitMultiStore(db2, log.NewNopLogger(), metrics.NewNoOpMetrics()).(*rootmulti.Store)
-			ver1 := ms1.LatestVersion()
-			ver2 := ms2.LatestVersion()
-			ms1.LoadVersion(ver1)
-			ms2.LoadVersion(ver2)
-		}
-		printCLIOutput(response, ms1, ms2)
-		if db1 != nil {
-			db1.Close()
-		}
-		if db2 != nil {
-			db2.Close()
-		}
+		printCLIOutput(response)
 	}
 
 	if !response.Success {
@@ -281,26 +741,36 @@ func runCLIComparison(source1, source2 string, jsonOutput bool) {
 
 func detectSourceType(source string) string {
 	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-		return "zip_url"
+		return "archive_url"
 	}
-	if strings.HasSuffix(strings.ToLower(source), ".zip") {
-		return "zip_file"
+	// Any plain file is treated as an archive; its format is sniffed from
+	// the content when it is extracted.
+	if info, err := os.Stat(source); isArchiveName(source) || (err == nil && info.Mode().IsRegular()) {
+		return "archive_file"
 	}
 	return "local"
 }
 
-// Generate a unique taskID for each comparison
+// generateTaskID returns a random ID for a comparison or upload. The IDs
+// are the only thing guarding results when authentication is off, so they
+// must not be guessable.
 func generateTaskID() string {
-	rand.Seed(time.Now().UnixNano())
-	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Intn(100000))
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate an ID: %v", err))
+	}
+	return hex.EncodeToString(id[:])
 }
 
 // Helper to copy a directory recursively
-func copyDir(src string, dst string) error {
+func copyDir(ctx context.Context, src string, dst string) error {
 	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		relPath, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
@@ -327,31 +797,15 @@ func copyDir(src string, dst string) error {
 	})
 }
 
-// Helper to extract a zip file to a directory
-func extractZipFromFile(zipPath, destDir string) error {
-	zipData, err := os.ReadFile(zipPath)
+// Helper to extract a zip file to a directory. The archive is read through
+// its central directory, so only one entry is in flight at a time.
+func extractZipFromFile(ctx context.Context, zipPath, destDir string, progress progressFunc) error {
+	reader, err := zip.OpenReader(zipPath)
 	if err != nil {
-		return fmt.Errorf("failed to read ZIP file: %v", err)
+		return fmt.Errorf("failed to open ZIP file: %v", err)
 	}
-	return extractZipFromBytes(zipData, destDir)
-}
-
-// Helper to download and extract a zip from URL to a directory
-func downloadAndExtractZipToDir(url, destDir string) error {
-	client := &http.Client{Timeout: 30 * time.Minute}
-	resp, err := client.Get(url)
-	if err != nil {
-		return fmt.Errorf("failed to download ZIP: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download ZIP: HTTP %d", resp.StatusCode)
-	}
-	zipData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read ZIP data: %v", err)
-	}
-	return extractZipFromBytes(zipData, destDir)
+	defer reader.Close()
+	return extractZip(ctx, &reader.Reader, destDir, progress)
 }
 
 // Add a helper to find the real DB directory if there's a single subdirectory
@@ -379,175 +833,147 @@ func findDBDir(root string) string {
 }
 
 // Refactor prepareDataSourceFromRequest to use taskID and dirName
-func prepareDataSourceFromRequest(req DataSourceRequest, taskID, dirName string) (*DataSource, error) {
+func prepareDataSourceFromRequest(ctx context.Context, req DataSourceRequest, taskID, dirName string, progress progressFunc) (*DataSource, error) {
 	targetDir := filepath.Join("inputs", taskID, dirName)
 	os.MkdirAll(targetDir, 0755)
 
-	switch req.Type {
-	case "local":
-		err := copyDir(req.Path, targetDir)
+	if req.Type == "upload" && req.UploadID != "" {
+		resolved, err := resolveUpload(req)
 		if err != nil {
-			return nil, fmt.Errorf("failed to copy local dir: %v", err)
+			return nil, err
 		}
-		finalDir := findDBDir(targetDir)
-		fmt.Printf("[INFO] Final data directory used for comparison: %s\n", finalDir)
-		return &DataSource{Path: finalDir, IsTemp: false}, nil
+		req = resolved
+	}
 
-	case "zip_file":
-		err := extractZipFromFile(req.Path, targetDir)
-		if err != nil {
-			return nil, fmt.Errorf("failed to extract zip file: %v", err)
+	switch req.Type {
+	case "local":
+		switch req.Mode {
+		case "", "copy":
+		case "readonly":
+			return openLocalInPlace(req)
+		case "link":
+			return cloneLocalSource(ctx, req, targetDir)
+		default:
+			return nil, fmt.Errorf("unsupported local mode %q (use \"copy\", \"readonly\" or \"link\")", req.Mode)
 		}
-		finalDir := findDBDir(targetDir)
-		fmt.Printf("[INFO] Final data directory used for comparison: %s\n", finalDir)
-		return &DataSource{Path: finalDir, IsTemp: false}, nil
-
-	case "zip_url":
-		err := downloadAndExtractZipToDir(req.URL, targetDir)
+		err := copyDir(ctx, req.Path, targetDir)
 		if err != nil {
-			return nil, fmt.Errorf("failed to download/extract zip: %v", err)
+			return nil, fmt.Errorf("failed to copy local dir: %v", err)
 		}
 		finalDir := findDBDir(targetDir)
 		fmt.Printf("[INFO] Final data directory used for comparison: %s\n", finalDir)
-		return &DataSource{Path: finalDir, IsTemp: false}, nil
+		return &DataSource{Path: finalDir, IsTemp: false, Backend: req.Backend}, nil
 
-	case "upload":
-		err := extractZipFromBytes(req.Data, targetDir)
-		if err != nil {
-			return nil, fmt.Errorf("failed to extract uploaded zip: %v", err)
+	case "archive_file", "zip_file", "archive_url", "zip_url", "upload":
+		if source, ok, err := prepareFromCache(ctx, req, targetDir, progress); ok {
+			return source, err
+		}
+		if err := extractSource(ctx, req, targetDir, progress); err != nil {
+			return nil, err
 		}
 		finalDir := findDBDir(targetDir)
 		fmt.Printf("[INFO] Final data directory used for comparison: %s\n", finalDir)
-		return &DataSource{Path: finalDir, IsTemp: false}, nil
+		return &DataSource{Path: finalDir, IsTemp: false, Backend: req.Backend}, nil
 
 	default:
 		return nil, fmt.Errorf("unsupported source type: %s", req.Type)
 	}
 }
 
-// Add a helper to recursively log directory contents
-func logDirContents(root string) {
-	fmt.Printf("[DEBUG] Listing contents of %s\n", root)
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Printf("  [ERROR] %s: %v\n", path, err)
-			return nil
-		}
-		rel, _ := filepath.Rel(root, path)
-		if rel == "." {
-			fmt.Printf("  [DIR]  %s\n", path)
-		} else if info.IsDir() {
-			fmt.Printf("  [DIR]  %s\n", rel)
-		} else {
-			fmt.Printf("  [FILE] %s\n", rel)
+// extractSource writes the data directory of an archive source below destDir,
+// verifying its sha256 first when one is given.
+func extractSource(ctx context.Context, req DataSourceRequest, destDir string, progress progressFunc) error {
+	switch req.Type {
+	case "archive_file", "zip_file":
+		if req.SHA256 != "" {
+			if err := verifyFileSHA256(req.Path, req.SHA256); err != nil {
+				return err
+			}
+		}
+		if err := extractArchiveFile(ctx, req.Path, req.Path, destDir, progress); err != nil {
+			return fmt.Errorf("failed to extract archive: %w", err)
 		}
-		return nil
-	})
-}
-
-func extractUploadedZip(data []byte, filename string) (*DataSource, error) {
-	tempDir, err := os.MkdirTemp("", "store-compare-upload-*")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %v", err)
-	}
-
-	extractDir := filepath.Join(tempDir, "extracted")
-	err = extractZipFromBytes(data, extractDir)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to extract uploaded ZIP: %v", err)
-	}
-
-	logDirContents(extractDir)
-	fmt.Printf("[INFO] Using extracted data directory for comparison: %s\n", extractDir)
-
-	return &DataSource{Path: extractDir, IsTemp: true}, nil
-}
-
-func downloadAndExtractZip(url string) (*DataSource, error) {
-	tempDir, err := os.MkdirTemp("", "store-compare-*")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %v", err)
-	}
-
-	client := &http.Client{Timeout: 30 * time.Minute}
-	resp, err := client.Get(url)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to download ZIP: %v", err)
-	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to download ZIP: HTTP %d", resp.StatusCode)
-	}
+	case "archive_url", "zip_url":
+		if err := downloadAndExtractArchive(ctx, req.URL, req.SHA256, destDir, progress); err != nil {
+			return fmt.Errorf("failed to download/extract archive: %w", err)
+		}
 
-	zipData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to read ZIP data: %v", err)
-	}
+	case "upload":
+		if req.SHA256 != "" {
+			if actual := fmt.Sprintf("%x", sha256.Sum256(req.Data)); !strings.EqualFold(actual, req.SHA256) {
+				return &checksumMismatchError{Expected: strings.ToLower(req.SHA256), Actual: actual}
+			}
+		}
+		if err := extractArchiveBytes(ctx, req.Data, req.Name, destDir, progress); err != nil {
+			return fmt.Errorf("failed to extract uploaded archive: %w", err)
+		}
 
-	extractDir := filepath.Join(tempDir, "extracted")
-	err = extractZipFromBytes(zipData, extractDir)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to extract ZIP: %v", err)
+	default:
+		return fmt.Errorf("unsupported source type: %s", req.Type)
 	}
-
-	logDirContents(extractDir)
-	fmt.Printf("[INFO] Using extracted data directory for comparison: %s\n", extractDir)
-
-	return &DataSource{Path: extractDir, IsTemp: true}, nil
+	return nil
 }
 
-func extractLocalZip(zipPath string) (*DataSource, error) {
-	tempDir, err := os.MkdirTemp("", "store-compare-*")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %v", err)
-	}
-
-	zipData, err := os.ReadFile(zipPath)
-	if err != nil {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to read ZIP file: %v", err)
-	}
-
-	extractDir := filepath.Join(tempDir, "extracted")
-	err = extractZipFromBytes(zipData, extractDir)
+func extractZipFromBytes(ctx context.Context, zipData []byte, destDir string, progress progressFunc) error {
+	reader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
 	if err != nil {
-		os.RemoveAll(tempDir)
-		return nil, fmt.Errorf("failed to extract ZIP: %v", err)
+		return err
 	}
-
-	logDirContents(extractDir)
-	fmt.Printf("[INFO] Using extracted data directory for comparison: %s\n", extractDir)
-
-	return &DataSource{Path: extractDir, IsTemp: true}, nil
+	return extractZip(ctx, reader, destDir, progress)
 }
 
-func extractZipFromBytes(zipData []byte, destDir string) error {
-	reader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+// extractZip writes every entry of reader below destDir, streaming each one
+// from the archive to its target file.
+func extractZip(ctx context.Context, reader *zip.Reader, destDir string, progress progressFunc) error {
+	err := os.MkdirAll(destDir, 0755)
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(destDir, 0755)
-	if err != nil {
+	budget := newExtractBudget(destDir)
+	var total int64
+	for _, file := range reader.File {
+		total += int64(file.UncompressedSize64)
+	}
+	if err := budget.checkTotal(len(reader.File), total); err != nil {
 		return err
 	}
 
-	for _, file := range reader.File {
+	var lastReport time.Time
+	for i, file := range reader.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if time.Since(lastReport) >= progressInterval {
+			lastReport = time.Now()
+			progress.report(ProgressEvent{Event: EventExtract, FilesExtracted: i, FilesTotal: len(reader.File)})
+		}
 		path := filepath.Join(destDir, file.Name)
 
 		if !strings.HasPrefix(path, filepath.Clean(destDir)+string(os.PathSeparator)) {
-			return fmt.Errorf("invalid file path in ZIP: %s", file.Name)
+			return limitf("entry %s escapes the destination directory", file.Name)
 		}
 
-		if file.FileInfo().IsDir() {
-			os.MkdirAll(path, file.FileInfo().Mode())
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			if err := budget.addEntry(file.Name, 0); err != nil {
+				return err
+			}
+			os.MkdirAll(path, 0755)
 			continue
+		case mode&os.ModeSymlink != 0:
+			return limitf("symlink entry %s is not allowed", file.Name)
+		case !mode.IsRegular():
+			return limitf("special file entry %s (%s) is not allowed", file.Name, mode.Type())
+		}
+		size := int64(file.UncompressedSize64)
+		if err := budget.addEntry(file.Name, size); err != nil {
+			return err
+		}
+		if err := budget.checkEntryRatio(file.Name, size, int64(file.CompressedSize64)); err != nil {
+			return err
 		}
 
 		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
@@ -559,19 +985,23 @@ func extractZipFromBytes(zipData []byte, destDir string) error {
 			return err
 		}
 
-		targetFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.FileInfo().Mode())
+		// Archive modes are ignored: DB files only need to be readable and
+		// writable by us.
+		targetFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			fileReader.Close()
 			return err
 		}
 
-		_, err = io.Copy(targetFile, fileReader)
+		// archive/zip fails entries that expand past their declared size.
+		_, err = io.Copy(budget.writer(targetFile), fileReader)
 		fileReader.Close()
 		targetFile.Close()
 		if err != nil {
 			return err
 		}
 	}
+	progress.report(ProgressEvent{Event: EventExtract, FilesExtracted: len(reader.File), FilesTotal: len(reader.File)})
 
 	return nil
 }
@@ -588,26 +1018,48 @@ type ComparisonResult struct {
 	Metadata ResponseMetadata
 }
 
-func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*ComparisonResult, error) {
+// compareStoresForAPI compares the two sources' application DBs at version1 and
+// version2 respectively. A zero version selects the latest committed height.
+func compareStoresForAPI(ctx context.Context, source1, source2 *DataSource, version1, version2 int64, options CompareOptions, progress progressFunc) (*ComparisonResult, error) {
 	// Open databases
-	db1, err := dbm.NewDB("application", dbm.GoLevelDBBackend, dataDir1)
+	db1, backend1, err := openApplicationDB(source1)
 	if err != nil {
-		return nil, fmt.Errorf("error opening database in %s: %v", dataDir1, err)
+		return nil, fmt.Errorf("source1: %v", err)
 	}
 	defer db1.Close()
 
-	db2, err := dbm.NewDB("application", dbm.GoLevelDBBackend, dataDir2)
+	db2, backend2, err := openApplicationDB(source2)
 	if err != nil {
-		return nil, fmt.Errorf("error opening database in %s: %v", dataDir2, err)
+		return nil, fmt.Errorf("source2: %v", err)
 	}
 	defer db2.Close()
 
+	decoder, err := newDifferenceDecoder(options)
+	if err != nil {
+		return nil, err
+	}
+
 	// Load multistores
-	ms1 := store.NewCommitMultiStore(db1, log.NewNopLogger(), metrics.NewNoOpMetrics()).(*rootmulti.Store)
-	ms2 := store.NewCommitMultiStore(db2, log.NewNopLogger(), metrics.NewNoOpMetrics()).(*rootmulti.Store)
+	ms1 := newMultiStore(db1, source1)
+	ms2 := newMultiStore(db2, source2)
 
-	ver1 := ms1.LatestVersion()
-	ver2 := ms2.LatestVersion()
+	available1, err := listAvailableVersions(db1)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions for source1: %v", err)
+	}
+	available2, err := listAvailableVersions(db2)
+	if err != nil {
+		return nil, fmt.Errorf("error listing versions for source2: %v", err)
+	}
+
+	ver1, err := resolveVersion(ms1, available1, version1, "source1")
+	if err != nil {
+		return nil, err
+	}
+	ver2, err := resolveVersion(ms2, available2, version2, "source2")
+	if err != nil {
+		return nil, err
+	}
 
 	// Get commit info
 	commitInfo1, err := ms1.GetCommitInfo(ver1)
@@ -637,6 +1089,12 @@ func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*Co
 	for k := range stores2 {
 		allStoreNames[k] = true
 	}
+	if decoder.chain == "" {
+		decoder.chain = chainCosmos
+		if isHeimdallStores(allStoreNames) {
+			decoder.chain = chainHeimdall
+		}
+	}
 
 	for storeName := range allStoreNames {
 		storeType := storetypes.StoreTypeIAVL
@@ -645,8 +1103,15 @@ func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*Co
 	}
 
 	// Load versions
-	ms1.LoadVersion(ver1)
-	ms2.LoadVersion(ver2)
+	if err := ms1.LoadVersion(ver1); err != nil {
+		return nil, fmt.Errorf("error loading source1 at height %d: %v", ver1, err)
+	}
+	if err := ms2.LoadVersion(ver2); err != nil {
+		return nil, fmt.Errorf("error loading source2 at height %d: %v", ver2, err)
+	}
+	src1 := storeSource{db: db1, ms: ms1, version: ver1}
+	src2 := storeSource{db: db2, ms: ms2, version: ver2}
+	progress.report(ProgressEvent{Event: EventStoresMounted, Stage: JobComparing, StoresMounted: len(allStoreNames)})
 
 	// Prepare results
 	var names []string
@@ -657,8 +1122,13 @@ func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*Co
 
 	var results []StoreComparison
 	summary := ComparisonSummary{}
+	differencesFound := 0
 
-	for _, name := range names {
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		progress.report(ProgressEvent{Event: EventStoreStarted, Stage: JobComparing, Store: name, StoreIndex: i + 1, StoreCount: len(names)})
 		h1, ok1 := stores1[name]
 		h2, ok2 := stores2[name]
 
@@ -691,19 +1161,30 @@ func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*Co
 			comparison.Status = "differ"
 			comparison.Hash1 = fmt.Sprintf("%x", h1)
 			comparison.Hash2 = fmt.Sprintf("%x", h2)
+			var treeDiff string
 			if options.DetailedOutput {
-				comparison.Differences = getStoreDifferences(ms1, ms2, name, options.MaxDiffsPerStore)
+				collector, stats := getStoreDifferences(ctx, src1, src2, name, options.MaxDiffsPerStore)
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				decoder.decode(ctx, name, collector.differences)
+				comparison.Differences = collector.differences
+				comparison.DifferenceCounts = &collector.counts
+				differencesFound += collector.counts.Total
 				comparison.StoreType1 = getStoreType(ms1, name)
 				comparison.StoreType2 = getStoreType(ms2, name)
+				if stats != nil {
+					treeDiff = formatIAVLTreeDiff(comparison.Differences, *stats)
+				}
 			}
 			summary.DifferingStores++
 
 			// Add latest version or error in Extra, with a helpful note
 			var extraInfo []string
-			ver1 := ms1.LatestVersion()
-			ver2 := ms2.LatestVersion()
-			extraInfo = append(extraInfo, fmt.Sprintf("source1 latest version: %d", ver1))
-			extraInfo = append(extraInfo, fmt.Sprintf("source2 latest version: %d", ver2))
+			extraInfo = append(extraInfo, fmt.Sprintf("source1 compared version: %d", ver1))
+			extraInfo = append(extraInfo, fmt.Sprintf("source2 compared version: %d", ver2))
+			extraInfo = append(extraInfo, fmt.Sprintf("source1 latest version: %d", ms1.LatestVersion()))
+			extraInfo = append(extraInfo, fmt.Sprintf("source2 latest version: %d", ms2.LatestVersion()))
 			missing1 := false
 			missing2 := false
 			if store1 := ms1.GetStoreByName(name); store1 != nil {
@@ -731,35 +1212,25 @@ func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*Co
 				extraInfo = append(extraInfo, fmt.Sprintf("note: Store '%s' is missing in source2 but present in source1. This may indicate a migration, deletion, or a difference in app versions.", name))
 			}
 			comparison.Extra = strings.Join(extraInfo, "; ")
+			if treeDiff != "" {
+				comparison.Extra += "\n" + treeDiff
+			}
 		}
 
+		progress.report(ProgressEvent{
+			Event:            EventStoreFinished,
+			Stage:            JobComparing,
+			Store:            name,
+			StoreIndex:       i + 1,
+			StoreCount:       len(names),
+			Status:           comparison.Status,
+			DifferencesFound: differencesFound,
+		})
+
 		if options.ShowMatchingStores || comparison.Status != "match" {
 			results = append(results, comparison)
 		}
 		summary.TotalStores++
-
-		if comparison.StoreType1 != "" && strings.Contains(strings.ToLower(comparison.StoreType1), "iavl") && comparison.Status == "differ" {
-			store1 := ms1.GetStoreByName(name)
-			store2 := ms2.GetStoreByName(name)
-			var tree1, tree2 *iavl.ImmutableTree
-			if t1, ok := store1.(interface{ GetImmutableTree() *iavl.ImmutableTree }); ok {
-				tree1 = t1.GetImmutableTree()
-			}
-			if t2, ok := store2.(interface{ GetImmutableTree() *iavl.ImmutableTree }); ok {
-				tree2 = t2.GetImmutableTree()
-			}
-			if tree1 != nil && tree2 != nil {
-				shape1 := getIAVLTreeShape(tree1)
-				shape2 := getIAVLTreeShape(tree2)
-				diffs := diffLines(shape1, shape2)
-				var sb strings.Builder
-				sb.WriteString("Tree Shape Diff (IAVL):\n")
-				for _, diff := range diffs {
-					sb.WriteString("  " + decodeHexInLine(diff) + "\n")
-				}
-				comparison.Extra = sb.String()
-			}
-		}
 	}
 
 	summary.IsIdentical = summary.MissingStores == 0 && summary.DifferingStores == 0
@@ -768,12 +1239,142 @@ func compareStoresForAPI(dataDir1, dataDir2 string, options CompareOptions) (*Co
 		Summary: summary,
 		Results: results,
 		Metadata: ResponseMetadata{
-			Source1Version: ver1,
-			Source2Version: ver2,
+			Source1Version:           ver1,
+			Source2Version:           ver2,
+			Source1AvailableVersions: compactVersions(available1),
+			Source2AvailableVersions: compactVersions(available2),
+			Source1Backend:           string(backend1),
+			Source2Backend:           string(backend2),
+			Chain:                    decoder.chain,
 		},
 	}, nil
 }
 
+// listAvailableVersions returns, in ascending order, the heights that have a
+// commit info record and whose IAVL roots are still present for every store
+// listed in that record. Heights whose trees were pruned are left out.
+func listAvailableVersions(db dbm.DB) ([]int64, error) {
+	commitVersions, err := listCommitVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each store's roots are read once; checking a height is then a lookup.
+	stores := map[string]iavlVersions{}
+	var versions []int64
+	for _, ver := range commitVersions {
+		cInfo, err := loadCommitInfo(db, ver)
+		if err != nil {
+			return nil, err
+		}
+		retained := true
+		for _, si := range cInfo.StoreInfos {
+			available, ok := stores[si.Name]
+			if !ok {
+				if available, err = newIAVLNodeReader(db, si.Name).versions(); err != nil {
+					return nil, fmt.Errorf("store %s: %v", si.Name, err)
+				}
+				stores[si.Name] = available
+			}
+			if !available.has(ver) {
+				retained = false
+				break
+			}
+		}
+		if retained {
+			versions = append(versions, ver)
+		}
+	}
+	return versions, nil
+}
+
+// listCommitVersions returns, in ascending order, every height that still has
+// a commit info record, regardless of whether its trees were pruned.
+func listCommitVersions(db dbm.DB) ([]int64, error) {
+	// Commit infos live under "s/<height>"; ':' sorts right after '9', so this
+	// range skips "s/k:<store>/" data and "s/latest".
+	itr, err := db.Iterator([]byte("s/0"), []byte("s/:"))
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var versions []int64
+	for ; itr.Valid(); itr.Next() {
+		ver, err := strconv.ParseInt(strings.TrimPrefix(string(itr.Key()), "s/"), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, ver)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// loadCommitInfo reads the commit info for a height straight from the DB,
+// without needing a mounted multistore.
+func loadCommitInfo(db dbm.DB, ver int64) (*storetypes.CommitInfo, error) {
+	bz, err := db.Get([]byte(fmt.Sprintf("s/%d", ver)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commit info at height %d: %v", ver, err)
+	}
+	if bz == nil {
+		return nil, fmt.Errorf("no commit info found at height %d", ver)
+	}
+	cInfo := &storetypes.CommitInfo{}
+	if err := cInfo.Unmarshal(bz); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal commit info at height %d: %v", ver, err)
+	}
+	return cInfo, nil
+}
+
+// resolveVersion picks the height to load for a source. A zero request means
+// the latest committed version; anything else must be one of the available
+// heights, otherwise the error lists what the DB still retains.
+func resolveVersion(ms *rootmulti.Store, available []int64, requested int64, source string) (int64, error) {
+	if requested == 0 {
+		return ms.LatestVersion(), nil
+	}
+	idx := sort.Search(len(available), func(i int) bool { return available[i] >= requested })
+	if idx < len(available) && available[idx] == requested {
+		return requested, nil
+	}
+	return 0, fmt.Errorf("height %d is not available in %s (pruned or not yet committed); available heights: %s",
+		requested, source, formatVersionRanges(compactVersions(available)))
+}
+
+// compactVersions collapses a sorted list of heights into consecutive ranges.
+func compactVersions(versions []int64) []VersionRange {
+	var ranges []VersionRange
+	for _, v := range versions {
+		if n := len(ranges); n > 0 && ranges[n-1].To+1 == v {
+			ranges[n-1].To = v
+			continue
+		}
+		ranges = append(ranges, VersionRange{From: v, To: v})
+	}
+	return ranges
+}
+
+func formatVersionRanges(ranges []VersionRange) string {
+	if len(ranges) == 0 {
+		return "none"
+	}
+	parts := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		if r.From == r.To {
+			parts = append(parts, fmt.Sprintf("%d", r.From))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.From, r.To))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
 func getSampleData(ms *rootmulti.Store, storeName, source string) *StoreSampleData {
 	store := ms.GetStoreByName(storeName)
 	if store == nil {
@@ -812,175 +1413,153 @@ func getStoreType(ms *rootmulti.Store, storeName string) string {
 	return fmt.Sprintf("%T", store)
 }
 
-func getStoreDifferences(ms1, ms2 *rootmulti.Store, storeName string, maxDiffs int) []StoreDifference {
-	var differences []StoreDifference
+// storeSource is one side of a comparison: the opened application DB, the
+// multistore loaded from it and the version being compared.
+type storeSource struct {
+	db      dbm.DB
+	ms      *rootmulti.Store
+	version int64
+}
+
+// getStoreDifferences diffs one store across both sources. IAVL stores go
+// through the merkle-guided diff and also return its stats; other stores, or
+// trees the node reader cannot walk, fall back to iterating both KV stores.
+func getStoreDifferences(ctx context.Context, src1, src2 storeSource, storeName string, maxDiffs int) (*diffCollector, *iavlDiffStats) {
+	collector := newDiffCollector(maxDiffs)
 
-	s1 := ms1.GetStoreByName(storeName)
-	s2 := ms2.GetStoreByName(storeName)
+	s1 := src1.ms.GetStoreByName(storeName)
+	s2 := src2.ms.GetStoreByName(storeName)
 
 	if s1 == nil || s2 == nil {
-		return differences
+		return collector, nil
 	}
 
 	// Try IAVL comparison
-	if t1, ok1 := s1.(interface{ GetImmutableTree() *iavl.ImmutableTree }); ok1 {
-		if t2, ok2 := s2.(interface{ GetImmutableTree() *iavl.ImmutableTree }); ok2 {
-			tree1 := t1.GetImmutableTree()
-			tree2 := t2.GetImmutableTree()
-			if tree1 != nil && tree2 != nil {
-				return compareIAVLTreesForAPI(tree1, tree2, maxDiffs)
-			}
+	if s1.GetStoreType() == storetypes.StoreTypeIAVL && s2.GetStoreType() == storetypes.StoreTypeIAVL {
+		r1 := newIAVLNodeReader(src1.db, storeName)
+		r2 := newIAVLNodeReader(src2.db, storeName)
+		stats, err := diffIAVLTrees(ctx, r1, r2, src1.version, src2.version, nil, collector.add)
+		if err == nil {
+			return collector, &stats
 		}
+		if ctx.Err() != nil {
+			return collector, nil
+		}
+		fmt.Printf("[WARN] IAVL diff of store %s failed, falling back to KV iteration: %v\n", storeName, err)
+		collector = newDiffCollector(maxDiffs)
 	}
 
 	// Fallback to KVStore comparison
 	if kv1, ok := s1.(storetypes.KVStore); ok {
 		if kv2, ok := s2.(storetypes.KVStore); ok {
-			return compareKVStoresForAPI(kv1, kv2, maxDiffs)
+			compareKVStoresForAPI(ctx, kv1, kv2, nil, collector.add)
 		}
 	}
 
-	return differences
+	return collector, nil
 }
 
-func compareIAVLTreesForAPI(tree1, tree2 *iavl.ImmutableTree, maxDiffs int) []StoreDifference {
-	var differences []StoreDifference
+// diffCollector keeps the first maxDiffs differences of a store as samples
+// while counting all of them.
+type diffCollector struct {
+	maxDiffs    int
+	differences []StoreDifference
+	counts      DifferenceCounts
+}
 
-	itr1, err := tree1.Iterator(nil, nil, true)
-	if err != nil {
-		return differences
+func newDiffCollector(maxDiffs int) *diffCollector {
+	return &diffCollector{
+		maxDiffs: maxDiffs,
+		counts:   DifferenceCounts{ByPrefix: map[string]int{}},
 	}
-	defer itr1.Close()
-
-	itr2, err := tree2.Iterator(nil, nil, true)
-	if err != nil {
-		return differences
-	}
-	defer itr2.Close()
-
-	diffCount := 0
-	for (itr1.Valid() || itr2.Valid()) && diffCount < maxDiffs {
-		if !itr1.Valid() {
-			k2, v2 := itr2.Key(), itr2.Value()
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source2",
-				Key:         string(k2),
-				KeyHex:      fmt.Sprintf("%x", k2),
-				Value2:      string(v2),
-				Value2Hex:   fmt.Sprintf("%x", v2),
-				Description: "Key exists only in source2",
-			})
-			diffCount++
-			itr2.Next()
-			continue
-		}
-
-		if !itr2.Valid() {
-			k1, v1 := itr1.Key(), itr1.Value()
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source1",
-				Key:         string(k1),
-				KeyHex:      fmt.Sprintf("%x", k1),
-				Value1:      string(v1),
-				Value1Hex:   fmt.Sprintf("%x", v1),
-				Description: "Key exists only in source1",
-			})
-			diffCount++
-			itr1.Next()
-			continue
-		}
-
-		k1, v1 := itr1.Key(), itr1.Value()
-		k2, v2 := itr2.Key(), itr2.Value()
+}
 
-		keyCompare := bytes.Compare(k1, k2)
-		if keyCompare < 0 {
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source1",
-				Key:         string(k1),
-				KeyHex:      fmt.Sprintf("%x", k1),
-				Value1:      string(v1),
-				Value1Hex:   fmt.Sprintf("%x", v1),
-				Description: "Key exists only in source1",
-			})
-			diffCount++
-			itr1.Next()
-		} else if keyCompare > 0 {
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source2",
-				Key:         string(k2),
-				KeyHex:      fmt.Sprintf("%x", k2),
-				Value2:      string(v2),
-				Value2Hex:   fmt.Sprintf("%x", v2),
-				Description: "Key exists only in source2",
-			})
-			diffCount++
-			itr2.Next()
-		} else {
-			if !bytes.Equal(v1, v2) {
-				differences = append(differences, StoreDifference{
-					Type:        "value_differ",
-					Key:         string(k1),
-					KeyHex:      fmt.Sprintf("%x", k1),
-					Value1:      string(v1),
-					Value1Hex:   fmt.Sprintf("%x", v1),
-					Value2:      string(v2),
-					Value2Hex:   fmt.Sprintf("%x", v2),
-					Description: "Values differ for the same key",
-				})
-				diffCount++
-			}
-			itr1.Next()
-			itr2.Next()
-		}
-	}
+// add records one difference. It always returns true so diff walks run to
+// the end and the counts stay complete.
+func (c *diffCollector) add(diff StoreDifference) bool {
+	if len(c.differences) < c.maxDiffs {
+		c.differences = append(c.differences, diff)
+	}
+	c.counts.Total++
+	switch diff.Type {
+	case "key_only_source1":
+		c.counts.KeyOnlySource1++
+	case "key_only_source2":
+		c.counts.KeyOnlySource2++
+	case "value_differ":
+		c.counts.ValueDiffer++
+	}
+	prefix := "(empty)"
+	if len(diff.KeyHex) >= 2 {
+		prefix = diff.KeyHex[:2]
+	}
+	c.counts.ByPrefix[prefix]++
+	return true
+}
 
-	return differences
+// makeStoreDifference builds a StoreDifference for a key present in one or
+// both sources; pass nil for the value a source does not have.
+func makeStoreDifference(diffType string, key, value1, value2 []byte) StoreDifference {
+	diff := StoreDifference{
+		Type:   diffType,
+		Key:    string(key),
+		KeyHex: fmt.Sprintf("%x", key),
+	}
+	if value1 != nil {
+		diff.Value1 = string(value1)
+		diff.Value1Hex = fmt.Sprintf("%x", value1)
+	}
+	if value2 != nil {
+		diff.Value2 = string(value2)
+		diff.Value2Hex = fmt.Sprintf("%x", value2)
+	}
+	switch diffType {
+	case "key_only_source1":
+		diff.Description = "Key exists only in source1"
+	case "key_only_source2":
+		diff.Description = "Key exists only in source2"
+	case "value_differ":
+		diff.Description = "Values differ for the same key"
+	}
+	return diff
 }
 
-func compareKVStoresForAPI(kv1, kv2 storetypes.KVStore, maxDiffs int) []StoreDifference {
-	var differences []StoreDifference
+// compareKVStoresForAPI merge-iterates both stores from the first key after
+// the given one (nil for all) and passes each difference to emit until it
+// returns false.
+func compareKVStoresForAPI(ctx context.Context, kv1, kv2 storetypes.KVStore, after []byte, emit func(StoreDifference) bool) error {
+	var start []byte
+	if after != nil {
+		start = append(append([]byte{}, after...), 0x00)
+	}
 
-	iter1 := kv1.Iterator(nil, nil)
+	iter1 := kv1.Iterator(start, nil)
 	if iter1 == nil {
-		return differences
+		return nil
 	}
 	defer iter1.Close()
 
-	iter2 := kv2.Iterator(nil, nil)
+	iter2 := kv2.Iterator(start, nil)
 	if iter2 == nil {
-		return differences
+		return nil
 	}
 	defer iter2.Close()
 
-	diffCount := 0
-	for (iter1.Valid() || iter2.Valid()) && diffCount < maxDiffs {
+	more := true
+	for steps := 0; more && (iter1.Valid() || iter2.Valid()); steps++ {
+		if steps%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
 		if !iter1.Valid() {
-			k2, v2 := iter2.Key(), iter2.Value()
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source2",
-				Key:         string(k2),
-				KeyHex:      fmt.Sprintf("%x", k2),
-				Value2:      string(v2),
-				Value2Hex:   fmt.Sprintf("%x", v2),
-				Description: "Key exists only in source2",
-			})
-			diffCount++
+			more = emit(makeStoreDifference("key_only_source2", iter2.Key(), nil, iter2.Value()))
 			iter2.Next()
 			continue
 		}
 
 		if !iter2.Valid() {
-			k1, v1 := iter1.Key(), iter1.Value()
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source1",
-				Key:         string(k1),
-				KeyHex:      fmt.Sprintf("%x", k1),
-				Value1:      string(v1),
-				Value1Hex:   fmt.Sprintf("%x", v1),
-				Description: "Key exists only in source1",
-			})
-			diffCount++
+			more = emit(makeStoreDifference("key_only_source1", iter1.Key(), iter1.Value(), nil))
 			iter1.Next()
 			continue
 		}
@@ -990,60 +1569,57 @@ func compareKVStoresForAPI(kv1, kv2 storetypes.KVStore, maxDiffs int) []StoreDif
 
 		keyCompare := bytes.Compare(k1, k2)
 		if keyCompare < 0 {
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source1",
-				Key:         string(k1),
-				KeyHex:      fmt.Sprintf("%x", k1),
-				Value1:      string(v1),
-				Value1Hex:   fmt.Sprintf("%x", v1),
-				Description: "Key exists only in source1",
-			})
-			diffCount++
+			more = emit(makeStoreDifference("key_only_source1", k1, v1, nil))
 			iter1.Next()
 		} else if keyCompare > 0 {
-			differences = append(differences, StoreDifference{
-				Type:        "key_only_source2",
-				Key:         string(k2),
-				KeyHex:      fmt.Sprintf("%x", k2),
-				Value2:      string(v2),
-				Value2Hex:   fmt.Sprintf("%x", v2),
-				Description: "Key exists only in source2",
-			})
-			diffCount++
+			more = emit(makeStoreDifference("key_only_source2", k2, nil, v2))
 			iter2.Next()
 		} else {
 			if !bytes.Equal(v1, v2) {
-				differences = append(differences, StoreDifference{
-					Type:        "value_differ",
-					Key:         string(k1),
-					KeyHex:      fmt.Sprintf("%x", k1),
-					Value1:      string(v1),
-					Value1Hex:   fmt.Sprintf("%x", v1),
-					Value2:      string(v2),
-					Value2Hex:   fmt.Sprintf("%x", v2),
-					Description: "Values differ for the same key",
-				})
-				diffCount++
+				more = emit(makeStoreDifference("value_differ", k1, v1, v2))
 			}
 			iter1.Next()
 			iter2.Next()
 		}
 	}
-
-	return differences
+	return nil
 }
 
-func printCLIOutput(response CompareResponse, ms1, ms2 *rootmulti.Store) {
+func printCLIOutput(response CompareResponse) {
 	if !response.Success {
 		fmt.Printf("❌ Comparison failed: %s\n", response.Error)
 		return
 	}
 
 	fmt.Printf("\n===== Store Comparison Result =====\n")
-	fmt.Printf("Source1 LatestVersion: %d\n", response.Metadata.Source1Version)
-	fmt.Printf("Source2 LatestVersion: %d\n", response.Metadata.Source2Version)
+	fmt.Printf("Source1 Version: %d (available: %s)\n", response.Metadata.Source1Version, formatVersionRanges(response.Metadata.Source1AvailableVersions))
+	fmt.Printf("Source2 Version: %d (available: %s)\n", response.Metadata.Source2Version, formatVersionRanges(response.Metadata.Source2AvailableVersions))
+	if response.Metadata.Source1Backend != "" {
+		fmt.Printf("Backends: %s / %s\n", response.Metadata.Source1Backend, response.Metadata.Source2Backend)
+	}
+	if response.Metadata.Chain == chainHeimdall {
+		fmt.Printf("Chain: %s\n", response.Metadata.Chain)
+	}
 	fmt.Printf("Comparison Time: %s\n", response.Metadata.ComparisonTime)
 	fmt.Printf("Processing Time: %s\n", response.Metadata.ProcessingTime)
+	if b := response.Bisect; b != nil {
+		fmt.Printf("\n--- Bisection ---\n")
+		fmt.Printf("Common Heights:         %d-%d\n", b.CommonFrom, b.CommonTo)
+		fmt.Printf("Heights Checked:        %d\n", b.HeightsChecked)
+		if b.LastMatchingHeight != 0 {
+			fmt.Printf("Last Matching Height:   %d\n", b.LastMatchingHeight)
+		}
+		if b.FirstDivergentHeight != 0 {
+			fmt.Printf("First Divergent Height: %d\n", b.FirstDivergentHeight)
+			for _, s := range b.DivergedStores {
+				fmt.Printf("  - %s [%s] %s -> %s\n", s.Name, s.Status, s.Hash1, s.Hash2)
+			}
+		}
+		if b.Note != "" {
+			fmt.Printf("Note: %s\n", b.Note)
+		}
+	}
+
 	fmt.Printf("\n--- Summary ---\n")
 	fmt.Printf("Total Stores:      %d\n", response.Summary.TotalStores)
 	fmt.Printf("Matching Stores:   %d\n", response.Summary.MatchingStores)
@@ -1085,84 +1661,75 @@ func printCLIOutput(response CompareResponse, ms1, ms2 *rootmulti.Store) {
 				}
 			}
 		}
+		if c := res.DifferenceCounts; c != nil && c.Total > 0 {
+			fmt.Printf("  Difference Counts: %d total (%d only in source1, %d only in source2, %d value differ)\n",
+				c.Total, c.KeyOnlySource1, c.KeyOnlySource2, c.ValueDiffer)
+			prefixes := make([]string, 0, len(c.ByPrefix))
+			for prefix := range c.ByPrefix {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			for _, prefix := range prefixes {
+				fmt.Printf("    prefix 0x%s: %d\n", prefix, c.ByPrefix[prefix])
+			}
+		}
 		if len(res.Differences) > 0 {
-			fmt.Printf("  Differences (showing up to %d):\n", len(res.Differences))
+			total := len(res.Differences)
+			if res.DifferenceCounts != nil {
+				total = res.DifferenceCounts.Total
+			}
+			fmt.Printf("  Differences (showing %d of %d):\n", len(res.Differences), total)
 			for i, diff := range res.Differences {
 				fmt.Printf("    %d. [%s] Key: '%s' (hex: %s)\n", i+1, diff.Type, diff.Key, diff.KeyHex)
-				if diff.Value1 != "" {
+				if diff.DecodedKey != nil {
+					fmt.Printf("       Decoded Key: %s\n", diff.DecodedKey)
+				}
+				if diff.Value1Decoded != nil {
+					fmt.Printf("       Value1 (%s): %s\n", diff.ValueType, diff.Value1Decoded)
+				} else if diff.Value1 != "" {
 					fmt.Printf("       Value1: '%s' (hex: %s)\n", diff.Value1, diff.Value1Hex)
 				}
-				if diff.Value2 != "" {
+				if diff.Value2Decoded != nil {
+					fmt.Printf("       Value2 (%s): %s\n", diff.ValueType, diff.Value2Decoded)
+				} else if diff.Value2 != "" {
 					fmt.Printf("       Value2: '%s' (hex: %s)\n", diff.Value2, diff.Value2Hex)
 				}
-				fmt.Printf("       Description: %s\n", diff.Description)
-			}
-			// Show tree shape diff for IAVL stores
-			if res.StoreType1 != "" && strings.Contains(strings.ToLower(res.StoreType1), "iavl") && res.Status == "differ" {
-				fmt.Printf("  Tree Shape Diff (IAVL):\n")
-				store1 := ms1.GetStoreByName(res.Name)
-				store2 := ms2.GetStoreByName(res.Name)
-				var tree1, tree2 *iavl.ImmutableTree
-				if t1, ok := store1.(interface{ GetImmutableTree() *iavl.ImmutableTree }); ok {
-					tree1 = t1.GetImmutableTree()
-				}
-				if t2, ok := store2.(interface{ GetImmutableTree() *iavl.ImmutableTree }); ok {
-					tree2 = t2.GetImmutableTree()
+				if diff.DecodeError != "" {
+					fmt.Printf("       Decode Error: %s\n", diff.DecodeError)
 				}
-				if tree1 != nil && tree2 != nil {
-					shape1 := getIAVLTreeShape(tree1)
-					shape2 := getIAVLTreeShape(tree2)
-					diffs := diffLines(shape1, shape2)
-					for _, diff := range diffs {
-						fmt.Printf("    %s\n", decodeHexInLine(diff))
+				if len(diff.FieldChanges) > 0 {
+					fmt.Printf("       Changed Fields:\n")
+					for _, change := range diff.FieldChanges {
+						fmt.Printf("         %s\n", change)
 					}
 				}
+				fmt.Printf("       Description: %s\n", diff.Description)
+			}
+		}
+		if res.Extra != "" && res.Status == "differ" {
+			fmt.Printf("  Details:\n")
+			for _, line := range strings.Split(strings.TrimRight(res.Extra, "\n"), "\n") {
+				fmt.Printf("    %s\n", line)
 			}
 		}
 	}
 	fmt.Printf("\n===================================\n\n")
 }
 
-// Refactor getIAVLTreeShape to use the iterator API
-func getIAVLTreeShape(tree *iavl.ImmutableTree) []string {
-	var lines []string
-	itr, err := tree.Iterator(nil, nil, true)
-	if err != nil {
-		return lines
-	}
-	defer itr.Close()
-	for ; itr.Valid(); itr.Next() {
-		lines = append(lines, fmt.Sprintf("key=%x value=%x", itr.Key(), itr.Value()))
-	}
-	return lines
-}
-
-// Add a function to diff two string slices (line-by-line)
-func diffLines(a, b []string) []string {
-	var diffs []string
-	alen, blen := len(a), len(b)
-	max := alen
-	if blen > max {
-		max = blen
-	}
-	for i := 0; i < max; i++ {
-		var left, right string
-		if i < alen {
-			left = a[i]
-		}
-		if i < blen {
-			right = b[i]
-		}
-		if left != right {
-			if left != "" {
-				diffs = append(diffs, "- "+left)
-			}
-			if right != "" {
-				diffs = append(diffs, "+ "+right)
-			}
+// formatIAVLTreeDiff renders the differing leaves found by the merkle-guided
+// diff as -/+ lines, with the number of nodes it had to read.
+func formatIAVLTreeDiff(differences []StoreDifference, stats iavlDiffStats) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Tree Diff (IAVL): read %d nodes, skipped %d identical subtrees\n", stats.NodesRead, stats.SubtreesSkipped)
+	for _, diff := range differences {
+		if diff.Type != "key_only_source2" {
+			sb.WriteString("  " + decodeHexInLine(fmt.Sprintf("- key=%s value=%s", diff.KeyHex, diff.Value1Hex)) + "\n")
+		}
+		if diff.Type != "key_only_source1" {
+			sb.WriteString("  " + decodeHexInLine(fmt.Sprintf("+ key=%s value=%s", diff.KeyHex, diff.Value2Hex)) + "\n")
 		}
 	}
-	return diffs
+	return sb.String()
 }
 
 // Add a function to decode hex in a line to ASCII
@@ -1189,39 +1756,110 @@ func hexStringToBytes(s string) ([]byte, error) {
 	return hex.DecodeString(s)
 }
 
-func performComparison(req CompareRequest) CompareResponse {
+func performComparison(ctx context.Context, req CompareRequest) CompareResponse {
+	return runComparison(ctx, generateTaskID(), req, nil)
+}
+
+// runComparison prepares both sources under inputs/<taskID> and compares them,
+// reporting each step to progress. If ctx ends first the comparison stops and
+// inputs/<taskID> is removed.
+func runComparison(ctx context.Context, taskID string, req CompareRequest, progress progressFunc) (response CompareResponse) {
 	startTime := time.Now()
+	defer func() {
+		if response.Success {
+			saveComparison(taskID, req, &response)
+		}
+	}()
+	defer func() {
+		if !response.Success {
+			switch ctx.Err() {
+			case context.DeadlineExceeded:
+				response.Error = fmt.Sprintf("Comparison exceeded the maximum runtime of %s", maxJobRuntime)
+			case context.Canceled:
+				response.Error = "Comparison was cancelled"
+			}
+		}
+	}()
 
-	response := CompareResponse{
+	response = CompareResponse{
 		Success: true,
 		Metadata: ResponseMetadata{
 			ComparisonTime: time.Now().UTC().Format(time.RFC3339),
 		},
 	}
 
-	// Generate a unique taskID for this comparison
-	taskID := generateTaskID()
+	// Catch bad decoding options before spending time on the sources.
+	if _, err := newDifferenceDecoder(req.Options); err != nil {
+		response.Success = false
+		response.Error = fmt.Sprintf("Invalid options: %v", err)
+		return response
+	}
+
 	inputDir := filepath.Join("inputs", taskID)
+	var source1, source2 *DataSource
+	retained := false
+	defer func() {
+		if !retained {
+			releaseSource(source1)
+			releaseSource(source2)
+		}
+	}()
 
 	// Prepare data sources
-	source1, err := prepareDataSourceFromRequest(req.Source1, taskID, "dir1")
+	progress.report(ProgressEvent{Event: EventStage, Stage: JobPreparingSource1})
+	source1, err := prepareDataSourceFromRequest(ctx, req.Source1, taskID, "dir1", progress.forSource(JobPreparingSource1, "source1"))
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Error preparing source1: %v", err)
+		response.ErrorType = errorType(err)
 		os.RemoveAll(inputDir)
 		return response
 	}
 
-	source2, err := prepareDataSourceFromRequest(req.Source2, taskID, "dir2")
+	progress.report(ProgressEvent{Event: EventStage, Stage: JobPreparingSource2})
+	source2, err = prepareDataSourceFromRequest(ctx, req.Source2, taskID, "dir2", progress.forSource(JobPreparingSource2, "source2"))
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Error preparing source2: %v", err)
+		response.ErrorType = errorType(err)
 		os.RemoveAll(inputDir)
 		return response
 	}
 
 	// Perform comparison
-	result, err := compareStoresForAPI(source1.Path, source2.Path, req.Options)
+	version1, version2 := requestedVersions(req)
+	progress.report(ProgressEvent{Event: EventStage, Stage: JobComparing})
+	if req.Options.Bisect {
+		bisect, err := bisectStores(ctx, source1, source2)
+		if err != nil {
+			response.Success = false
+			response.Error = fmt.Sprintf("Bisection failed: %v", err)
+			response.ErrorType = errorType(err)
+			if response.ErrorType == "" {
+				response.ErrorType = ErrorTypeInternal
+			}
+			os.RemoveAll(inputDir)
+			return response
+		}
+		response.Bisect = bisect
+		if bisect.FirstDivergentHeight == 0 {
+			response.Summary.IsIdentical = true
+			response.Metadata.ProcessingTime = time.Since(startTime).String()
+			os.RemoveAll(inputDir)
+			return response
+		}
+		version1, version2 = bisect.FirstDivergentHeight, bisect.FirstDivergentHeight
+	}
+	result, err := compareStoresForAPI(ctx, source1, source2, version1, version2, req.Options, progress)
+	if err != nil && response.Bisect != nil && ctx.Err() == nil {
+		// The divergent height is known even when its trees were pruned; keep
+		// the bisection result and explain why there is no store-level diff.
+		response.Bisect.Note = strings.TrimPrefix(response.Bisect.Note+"; ", "; ") +
+			fmt.Sprintf("could not compare stores at height %d: %v", version1, err)
+		response.Metadata.ProcessingTime = time.Since(startTime).String()
+		os.RemoveAll(inputDir)
+		return response
+	}
 	if err != nil {
 		response.Success = false
 		response.Error = fmt.Sprintf("Comparison failed: %v", err)
@@ -1233,10 +1871,44 @@ func performComparison(req CompareRequest) CompareResponse {
 	response.Results = result.Results
 	response.Metadata.Source1Version = result.Metadata.Source1Version
 	response.Metadata.Source2Version = result.Metadata.Source2Version
+	response.Metadata.Source1AvailableVersions = result.Metadata.Source1AvailableVersions
+	response.Metadata.Source2AvailableVersions = result.Metadata.Source2AvailableVersions
+	response.Metadata.Source1Backend = result.Metadata.Source1Backend
+	response.Metadata.Source2Backend = result.Metadata.Source2Backend
+	response.Metadata.Chain = result.Metadata.Chain
 	response.Metadata.ProcessingTime = time.Since(startTime).String()
 
-	// Clean up after processing
-	os.RemoveAll(inputDir)
+	// Keep the inputs around for paging through differences, or clean up
+	// right away when retention is off. Pages decode with the detected chain.
+	options := req.Options
+	options.Chain = result.Metadata.Chain
+	retained = retainComparison(taskID, &retainedComparison{
+		source1:  source1,
+		source2:  source2,
+		version1: result.Metadata.Source1Version,
+		version2: result.Metadata.Source2Version,
+		options:  options,
+		inputDir: inputDir,
+		owner:    req.Owner,
+	})
+	if retained {
+		response.Metadata.ComparisonID = taskID
+	} else {
+		os.RemoveAll(inputDir)
+	}
 
 	return response
 }
+
+// requestedVersions returns the heights to compare for each source: a
+// per-source Version wins over the shared Options.Height.
+func requestedVersions(req CompareRequest) (int64, int64) {
+	version1, version2 := req.Options.Height, req.Options.Height
+	if req.Source1.Version != 0 {
+		version1 = req.Source1.Version
+	}
+	if req.Source2.Version != 0 {
+		version2 = req.Source2.Version
+	}
+	return version1, version2
+}
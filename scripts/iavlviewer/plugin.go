@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pluginTimeout bounds how long a decoder may take to answer one line
+	// before its process is killed and restarted.
+	pluginTimeout = 10 * time.Second
+	// pluginCacheEntries caps the decoded values each decoder keeps.
+	pluginCacheEntries = 100000
+)
+
+// decoderPlugins are the external decoders configured with --decoder, by
+// store name. They are set up at startup and shared by all comparisons.
+var decoderPlugins = map[string]*decoderPlugin{}
+
+// decoderPlugin decodes the keys and values of one store with an external
+// executable. The process is started on first use and kept running; for each
+// value it is sent a line
+//
+//	{"store":"wasm","key":"<hex>","value":"<hex>"}
+//
+// and answers with a line
+//
+//	{"type":"...","value":<JSON>,"key":{"prefix":"...","fields":[{"name":"...","value":"..."}]}}
+//
+// or {"error":"..."}, where type and key are optional. Answers are cached by
+// key and value until the executable changes.
+type decoderPlugin struct {
+	store   string
+	command []string
+
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// lines carries the process's output lines; it is closed when the
+	// process exits.
+	lines chan []byte
+	// modTime is the executable's modification time the cache and the
+	// process belong to.
+	modTime time.Time
+	cache   map[[32]byte]*list.Element
+	lru     *list.List
+}
+
+type pluginRequest struct {
+	Store string `json:"store"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type pluginResponse struct {
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Key   *DecodedKey     `json:"key,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type pluginCacheEntry struct {
+	id       [32]byte
+	response pluginResponse
+}
+
+// addDecoderPlugin configures the decoder given as "STORE=COMMAND", where the
+// command is an executable followed by any arguments, split on spaces.
+func addDecoderPlugin(spec string) error {
+	store, command, ok := strings.Cut(spec, "=")
+	args := strings.Fields(command)
+	if !ok || store == "" || len(args) == 0 {
+		return fmt.Errorf("expected STORE=COMMAND")
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	args[0] = path
+	decoderPlugins[store] = &decoderPlugin{store: store, command: args, cache: map[[32]byte]*list.Element{}, lru: list.New()}
+	return nil
+}
+
+// decodeValues decodes both values of diff, and its key if the decoder
+// returns one.
+func (p *decoderPlugin) decodeValues(ctx context.Context, diff *StoreDifference) {
+	diff.ValueType = "plugin"
+	var errs []string
+	decodeSide := func(valueHex, side string) json.RawMessage {
+		res, err := p.decode(ctx, diff.KeyHex, valueHex)
+		if err == nil && res.Error != "" {
+			err = fmt.Errorf("%s", res.Error)
+		}
+		if err != nil {
+			errs = append(errs, side+": "+err.Error())
+			return nil
+		}
+		if res.Key != nil {
+			key := *res.Key
+			if key.Module == "" {
+				key.Module = p.store
+			}
+			diff.DecodedKey = &key
+		}
+		if res.Type != "" {
+			diff.ValueType = res.Type
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, res.Value); err != nil {
+			errs = append(errs, side+": decoder returned no value")
+			return nil
+		}
+		return compact.Bytes()
+	}
+	if diff.Type != "key_only_source2" {
+		diff.Value1Decoded = decodeSide(diff.Value1Hex, "value1")
+	}
+	if diff.Type != "key_only_source1" {
+		diff.Value2Decoded = decodeSide(diff.Value2Hex, "value2")
+	}
+	diff.DecodeError = strings.Join(errs, "; ")
+	if diff.Value1Decoded != nil && diff.Value2Decoded != nil {
+		diff.FieldChanges = diffJSON(diff.Value1Decoded, diff.Value2Decoded)
+	}
+}
+
+// decode returns the decoder's answer for a key and value, from the cache
+// when it has been asked before. Failures to run the decoder are errors;
+// errors it reports itself are in the response and cached like any answer.
+func (p *decoderPlugin) decode(ctx context.Context, keyHex, valueHex string) (pluginResponse, error) {
+	id := sha256.Sum256([]byte(keyHex + ":" + valueHex))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkExecutableLocked()
+	if e, ok := p.cache[id]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(*pluginCacheEntry).response, nil
+	}
+
+	res, err := p.exchangeLocked(ctx, pluginRequest{Store: p.store, Key: keyHex, Value: valueHex})
+	if err != nil {
+		return res, err
+	}
+	p.cache[id] = p.lru.PushFront(&pluginCacheEntry{id: id, response: res})
+	if p.lru.Len() > pluginCacheEntries {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.cache, oldest.Value.(*pluginCacheEntry).id)
+	}
+	return res, nil
+}
+
+// exchangeLocked sends one request line and reads the answer, starting the
+// process first if it isn't running. A process that exits, times out or
+// answers with something other than JSON is stopped, to be started again for
+// the next request. So is one whose request is abandoned because ctx ends,
+// as its late answer would be taken for the next one.
+func (p *decoderPlugin) exchangeLocked(ctx context.Context, req pluginRequest) (pluginResponse, error) {
+	var res pluginResponse
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	if p.cmd == nil {
+		if err := p.startLocked(); err != nil {
+			return res, fmt.Errorf("failed to start decoder: %v", err)
+		}
+	}
+
+	// A decoder that stops reading blocks the write once the pipe is full;
+	// the timeout covers it, and stopping the process unblocks it.
+	line, _ := json.Marshal(req)
+	written := make(chan error, 1)
+	go func(stdin io.Writer) {
+		_, err := stdin.Write(append(line, '\n'))
+		written <- err
+	}(p.stdin)
+
+	timer := time.NewTimer(pluginTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				p.stopLocked()
+				return res, fmt.Errorf("decoder exited: %v", err)
+			}
+			written = nil
+		case answer, ok := <-p.lines:
+			if !ok {
+				p.stopLocked()
+				return res, fmt.Errorf("decoder exited")
+			}
+			if err := json.Unmarshal(answer, &res); err != nil {
+				p.stopLocked()
+				return res, fmt.Errorf("invalid answer from decoder: %v", err)
+			}
+			return res, nil
+		case <-timer.C:
+			p.stopLocked()
+			return res, fmt.Errorf("decoder did not answer within %s", pluginTimeout)
+		case <-ctx.Done():
+			p.stopLocked()
+			return res, ctx.Err()
+		}
+	}
+}
+
+// checkExecutableLocked drops the cached answers and stops the process once
+// the executable has been replaced, so a new decoder build takes effect
+// without restarting the server.
+func (p *decoderPlugin) checkExecutableLocked() {
+	info, err := os.Stat(p.command[0])
+	if err != nil || info.ModTime().Equal(p.modTime) {
+		return
+	}
+	if !p.modTime.IsZero() {
+		fmt.Printf("[Decoder] %s changed, clearing the cached values of store %s\n", p.command[0], p.store)
+	}
+	p.modTime = info.ModTime()
+	p.cache = map[[32]byte]*list.Element{}
+	p.lru.Init()
+	p.stopLocked()
+}
+
+func (p *decoderPlugin) startLocked() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("[Decoder] Started %s for store %s (pid %d)\n", p.command[0], p.store, cmd.Process.Pid)
+
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+		cmd.Wait()
+	}()
+	p.cmd, p.stdin, p.lines = cmd, stdin, lines
+	return nil
+}
+
+// stopLocked kills the process and drains any output it left unread, so the
+// reader goroutine can finish.
+func (p *decoderPlugin) stopLocked() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	go func(lines chan []byte) {
+		for range lines {
+		}
+	}(p.lines)
+	p.cmd, p.stdin, p.lines = nil, nil, nil
+}
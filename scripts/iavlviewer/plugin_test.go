@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPlugin configures a decoder running the given shell script.
+func testPlugin(t *testing.T, script string) *decoderPlugin {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("decoder scripts need a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "decoder")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := addDecoderPlugin("wasm=" + path); err != nil {
+		t.Fatal(err)
+	}
+	p := decoderPlugins["wasm"]
+	delete(decoderPlugins, "wasm")
+	t.Cleanup(func() {
+		p.mu.Lock()
+		p.stopLocked()
+		p.mu.Unlock()
+	})
+	return p
+}
+
+func TestDecoderPluginValues(t *testing.T) {
+	p := testPlugin(t, `while read line; do
+  case "$line" in
+  *'"value":"01"'*) echo '{"type":"Counter","value":{"n":1}}' ;;
+  *) echo '{"type":"Counter","value":{"n":2},"key":{"prefix":"counter"}}' ;;
+  esac
+done
+`)
+	diff := StoreDifference{Type: "value_differ", KeyHex: "aa", Value1Hex: "01", Value2Hex: "02"}
+	p.decodeValues(context.Background(), &diff)
+	if diff.DecodeError != "" {
+		t.Fatal(diff.DecodeError)
+	}
+	if diff.ValueType != "Counter" || string(diff.Value1Decoded) != `{"n":1}` || string(diff.Value2Decoded) != `{"n":2}` {
+		t.Errorf("decoded %s: %s -> %s", diff.ValueType, diff.Value1Decoded, diff.Value2Decoded)
+	}
+	if diff.DecodedKey == nil || diff.DecodedKey.Prefix != "counter" || diff.DecodedKey.Module != "wasm" {
+		t.Errorf("decoded key = %+v", diff.DecodedKey)
+	}
+	if len(diff.FieldChanges) != 1 || diff.FieldChanges[0].String() != "n: 1 -> 2" {
+		t.Errorf("field changes = %v", diff.FieldChanges)
+	}
+	if p.lru.Len() != 2 {
+		t.Errorf("cached %d answers, want 2", p.lru.Len())
+	}
+}
+
+func TestDecoderPluginCancel(t *testing.T) {
+	// The decoder never reads its input, so a value larger than the pipe
+	// buffer blocks the write until the request is abandoned.
+	p := testPlugin(t, "exec sleep 60\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := p.decode(ctx, "aa", strings.Repeat("00", 1<<20))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > pluginTimeout/2 {
+		t.Errorf("cancellation took %s", elapsed)
+	}
+	p.mu.Lock()
+	running := p.cmd != nil
+	p.mu.Unlock()
+	if running {
+		t.Error("decoder still running after its request was abandoned")
+	}
+
+	// Requests on an ended context don't start the decoder again.
+	if _, err := p.decode(ctx, "aa", "01"); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sourcePolicy restricts what a server-mode request may ask the server to
+// read: local paths must lie below one of localRoots, and URLs must use an
+// allowed scheme and host and must not reach private addresses.
+type sourcePolicy struct {
+	localRoots []string
+	schemes    []string
+	// hosts are exact host names or "*.example.com" suffixes. Empty allows
+	// any host.
+	hosts        []string
+	allowPrivate bool
+}
+
+// policy is nil in CLI mode, where the user picks the sources themselves.
+var policy *sourcePolicy
+
+// sourceHTTPClient fetches archive URLs. Server mode replaces it with a
+// client that refuses to connect to private addresses.
+var sourceHTTPClient = http.DefaultClient
+
+// sourceRejectedError is a source the policy doesn't allow; the API answers
+// it with 403 Forbidden.
+type sourceRejectedError struct {
+	Reason string
+}
+
+func (e *sourceRejectedError) Error() string {
+	return e.Reason
+}
+
+func rejectf(format string, args ...any) error {
+	return &sourceRejectedError{Reason: fmt.Sprintf(format, args...)}
+}
+
+func newSourcePolicy(localRoots, schemes, hosts []string, allowPrivate bool) (*sourcePolicy, error) {
+	p := &sourcePolicy{schemes: schemes, allowPrivate: allowPrivate}
+	for _, root := range localRoots {
+		resolved, err := resolvePath(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --allow-local-root %s: %v", root, err)
+		}
+		p.localRoots = append(p.localRoots, resolved)
+	}
+	for _, host := range hosts {
+		p.hosts = append(p.hosts, strings.ToLower(host))
+	}
+	return p, nil
+}
+
+// resolvePath makes path absolute and resolves symlinks, so a link inside an
+// allowed root can't point outside of it.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// checkSources applies the policy to both sources of a request.
+func (p *sourcePolicy) checkSources(ctx context.Context, req CompareRequest) error {
+	if err := p.checkSource(ctx, req.Source1); err != nil {
+		return rejectf("source1 rejected: %v", err)
+	}
+	if err := p.checkSource(ctx, req.Source2); err != nil {
+		return rejectf("source2 rejected: %v", err)
+	}
+	if path := req.Options.ProtoDescriptors; p != nil && path != "" {
+		if err := p.checkPath(path); err != nil {
+			return rejectf("proto_descriptors rejected: %v", err)
+		}
+	}
+	return nil
+}
+
+func (p *sourcePolicy) checkSource(ctx context.Context, req DataSourceRequest) error {
+	if p == nil {
+		return nil
+	}
+	switch req.Type {
+	case "local", "archive_file", "zip_file":
+		return p.checkPath(req.Path)
+	case "archive_url", "zip_url":
+		return p.checkURL(ctx, req.URL)
+	}
+	return nil
+}
+
+func (p *sourcePolicy) checkPath(path string) error {
+	if len(p.localRoots) == 0 {
+		return errors.New("local paths are disabled; start the server with --allow-local-root")
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", path)
+	}
+	for _, root := range p.localRoots {
+		if resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside the allowed local roots", path)
+}
+
+// checkURL validates the scheme and host of rawURL and, unless private
+// addresses are allowed, that the host doesn't resolve to one. The dialer
+// checks again on connect, which also covers redirects and DNS changes.
+func (p *sourcePolicy) checkURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", rawURL)
+	}
+	if !p.allowedScheme(u.Scheme) {
+		return fmt.Errorf("URL scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if !p.allowedHost(host) {
+		return fmt.Errorf("URL host %s is not allowed", host)
+	}
+	if p.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if isPrivateAddr(addr) {
+			return fmt.Errorf("URL host %s resolves to the private address %s", host, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+func (p *sourcePolicy) allowedScheme(scheme string) bool {
+	for _, s := range p.schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *sourcePolicy) allowedHost(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+	for _, h := range p.hosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// netip.Addr.IsPrivate doesn't cover.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPrivateAddr reports whether addr is loopback, private, link-local (which
+// includes cloud metadata endpoints such as 169.254.169.254), unspecified or
+// multicast.
+func isPrivateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() ||
+		addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
+
+// newSourceHTTPClient returns a client that follows the policy on every
+// connection and redirect. The proxy environment variables are only honored
+// with --allow-private-urls.
+func (p *sourcePolicy) newSourceHTTPClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !p.allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return rejectf("cannot check address %s", address)
+			}
+			if isPrivateAddr(addrPort.Addr()) {
+				return rejectf("connection to the private address %s is not allowed", addrPort.Addr().Unmap())
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if !p.allowPrivate {
+		// Through a proxy the dialer would only ever see the proxy's
+		// address, so HTTP_PROXY and friends would bypass the check.
+		transport.Proxy = nil
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !p.allowedScheme(req.URL.Scheme) || !p.allowedHost(strings.ToLower(req.URL.Hostname())) {
+				return rejectf("redirect to %s is not allowed", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceHTTPClientProxy(t *testing.T) {
+	for _, allowPrivate := range []bool{false, true} {
+		p, err := newSourcePolicy(nil, []string{"http", "https"}, nil, allowPrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxied := p.newSourceHTTPClient().Transport.(*http.Transport).Proxy != nil
+		if proxied != allowPrivate {
+			t.Errorf("allowPrivate=%v: proxy enabled = %v", allowPrivate, proxied)
+		}
+	}
+}
+
+// TestSourceRejectedWhileDownloading checks that a source the policy refuses
+// only once it is fetched fails like one refused up front.
+func TestSourceRejectedWhileDownloading(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://127.0.0.1:1/snapshot.tar", http.StatusFound)
+	}))
+	defer srv.Close()
+	redirecting := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name         string
+		allowPrivate bool
+		hosts        []string
+		url          string
+	}{
+		// The dialer sees the address a public name resolves to.
+		{name: "private address", url: srv.URL},
+		{name: "redirect to a host outside the allowlist", allowPrivate: true, hosts: []string{"localhost"}, url: redirecting},
+	}
+	saved := sourceHTTPClient
+	defer func() { sourceHTTPClient = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newSourcePolicy(nil, []string{"http"}, tt.hosts, tt.allowPrivate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sourceHTTPClient = p.newSourceHTTPClient()
+			req := DataSourceRequest{Type: "archive_url", URL: tt.url}
+			err = extractSource(context.Background(), req, filepath.Join(t.TempDir(), "dir1"), nil)
+			if errorType(err) != ErrorTypeSourceRejected {
+				t.Fatalf("errorType(%v) = %q, want %q", err, errorType(err), ErrorTypeSourceRejected)
+			}
+			if code := failureStatus(CompareResponse{ErrorType: errorType(err)}); code != http.StatusForbidden {
+				t.Errorf("failureStatus = %d, want 403", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	EventQueued        = "queued"
+	EventStage         = "stage"
+	EventDownload      = "download"
+	EventExtract       = "extract"
+	EventCacheHit      = "cache_hit"
+	EventStoresMounted = "stores_mounted"
+	EventStoreStarted  = "store_started"
+	EventStoreFinished = "store_finished"
+	EventFinished      = "finished"
+)
+
+// progressInterval throttles the download and extraction events, which would
+// otherwise fire for every read or file.
+const progressInterval = 500 * time.Millisecond
+
+// ProgressEvent describes a step of a running comparison.
+type ProgressEvent struct {
+	Seq    int64  `json:"seq"`
+	Event  string `json:"event"` // one of the Event* constants
+	Stage  string `json:"stage"` // one of the Job* constants
+	Source string `json:"source,omitempty"`
+
+	// QueuePosition is the job's 1-based place in the queue on queued.
+	QueuePosition int `json:"queue_position,omitempty"`
+
+	BytesDownloaded int64 `json:"bytes_downloaded,omitempty"`
+	// BytesTotal is the Content-Length of the download, or -1 when unknown.
+	BytesTotal     int64 `json:"bytes_total,omitempty"`
+	FilesExtracted int   `json:"files_extracted,omitempty"`
+	FilesTotal     int   `json:"files_total,omitempty"`
+	StoresMounted  int   `json:"stores_mounted,omitempty"`
+
+	Store      string `json:"store,omitempty"`
+	StoreIndex int    `json:"store_index,omitempty"`
+	StoreCount int    `json:"store_count,omitempty"`
+	// Status is the store's comparison status on store_finished.
+	Status string `json:"status,omitempty"`
+	// DifferencesFound counts the key differences found so far across all
+	// stores. Keys are only compared when detailed_output is set.
+	DifferencesFound int `json:"differences_found,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// progressFunc receives progress updates from a running comparison; a nil
+// progressFunc ignores them, which is what the CLI uses.
+type progressFunc func(ProgressEvent)
+
+func (p progressFunc) report(ev ProgressEvent) {
+	if p != nil {
+		p(ev)
+	}
+}
+
+// forSource tags every event with the stage and source it belongs to, so the
+// download and extraction helpers don't need to know which side they prepare.
+func (p progressFunc) forSource(stage, source string) progressFunc {
+	if p == nil {
+		return nil
+	}
+	return func(ev ProgressEvent) {
+		ev.Stage = stage
+		ev.Source = source
+		p(ev)
+	}
+}
+
+// progressReader reports the bytes read through it at most every
+// progressInterval, plus once more on EOF.
+type progressReader struct {
+	r        io.Reader
+	total    int64
+	read     int64
+	last     time.Time
+	progress progressFunc
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.read += int64(n)
+	if err == io.EOF || time.Since(pr.last) >= progressInterval {
+		pr.last = time.Now()
+		pr.progress.report(ProgressEvent{Event: EventDownload, BytesDownloaded: pr.read, BytesTotal: pr.total})
+	}
+	return n, err
+}
+
+func handleJobEventsAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[Jobs] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(JobStatus{Error: "Method not allowed. Use GET."})
+		return
+	}
+	j := lookupJob(r, r.PathValue("id"))
+	if j == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(JobStatus{ID: r.PathValue("id"), Error: "Job not found"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(JobStatus{ID: r.PathValue("id"), Error: "Streaming is not supported by this connection"})
+		return
+	}
+
+	// EventSource sends Last-Event-ID on reconnect; resume after it.
+	var lastSeq int64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		lastSeq, _ = strconv.ParseInt(id, 10, 64)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		events, changed, finished := j.eventsAfter(lastSeq)
+		for _, ev := range events {
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Event, data)
+			lastSeq = ev.Seq
+		}
+		flusher.Flush()
+		if finished {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
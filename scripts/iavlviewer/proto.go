@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoRegistry holds the message types loaded from user-supplied
+// descriptors. Well-known types resolve from the linked-in registry.
+type protoRegistry struct {
+	types *dynamicpb.Types
+}
+
+// protoRegistryCacheEntries caps the loaded registries kept in memory.
+const protoRegistryCacheEntries = 16
+
+var (
+	protoRegistriesMu sync.Mutex
+	// protoRegistries caches loaded registries by where their descriptors
+	// come from, so a directory of .proto files is only compiled again once
+	// it changes. The least recently used entry is dropped beyond
+	// protoRegistryCacheEntries.
+	protoRegistries  = map[string]*list.Element{}
+	protoRegistryLRU = list.New()
+)
+
+type protoRegistryEntry struct {
+	// source is the path or the hash of an inline set; version tells the
+	// contents of a path apart as they change.
+	source, version string
+	reg             *protoRegistry
+}
+
+// loadProtoRegistry loads a FileDescriptorSet (as written by
+// "protoc --include_imports -o" or "buf build -o") from path, or compiles the
+// .proto files below path when it is a directory. Imports resolve relative to
+// the directory; google/protobuf imports are built in, anything else (such as
+// gogoproto/gogo.proto) must be in it. An inline descriptor set is used
+// instead when set is given.
+func loadProtoRegistry(path string, set []byte) (*protoRegistry, error) {
+	source, version, err := protoRegistryKey(path, set)
+	if err != nil {
+		return nil, err
+	}
+	if reg := cachedProtoRegistry(source, version); reg != nil {
+		return reg, nil
+	}
+
+	var files *protoregistry.Files
+	switch info, statErr := os.Stat(path); {
+	case set != nil:
+		files, err = parseDescriptorSet(set)
+	case statErr != nil:
+		return nil, fmt.Errorf("failed to read proto descriptors: %v", statErr)
+	case info.IsDir():
+		files, err = compileProtoDir(path)
+	default:
+		set, err = os.ReadFile(path)
+		if err == nil {
+			files, err = parseDescriptorSet(set)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	reg := &protoRegistry{types: dynamicpb.NewTypes(files)}
+	cacheProtoRegistry(&protoRegistryEntry{source: source, version: version, reg: reg})
+	return reg, nil
+}
+
+func cachedProtoRegistry(source, version string) *protoRegistry {
+	protoRegistriesMu.Lock()
+	defer protoRegistriesMu.Unlock()
+	e, ok := protoRegistries[source]
+	if !ok || e.Value.(*protoRegistryEntry).version != version {
+		return nil
+	}
+	protoRegistryLRU.MoveToFront(e)
+	return e.Value.(*protoRegistryEntry).reg
+}
+
+// cacheProtoRegistry adds a loaded registry, replacing an older version from
+// the same source. Registries are loaded without holding the lock, so two
+// comparisons may load the same one; the later simply wins.
+func cacheProtoRegistry(entry *protoRegistryEntry) {
+	protoRegistriesMu.Lock()
+	defer protoRegistriesMu.Unlock()
+	if e, ok := protoRegistries[entry.source]; ok {
+		protoRegistryLRU.Remove(e)
+	}
+	protoRegistries[entry.source] = protoRegistryLRU.PushFront(entry)
+	if protoRegistryLRU.Len() > protoRegistryCacheEntries {
+		oldest := protoRegistryLRU.Back()
+		protoRegistryLRU.Remove(oldest)
+		delete(protoRegistries, oldest.Value.(*protoRegistryEntry).source)
+	}
+}
+
+// protoRegistryKey identifies the descriptors to load: the hash of an inline
+// set, or the path with, as its version, the size and modification time of
+// the file or of every .proto file below the directory.
+func protoRegistryKey(path string, set []byte) (source, version string, err error) {
+	if set != nil {
+		return fmt.Sprintf("set:%x", sha256.Sum256(set)), "", nil
+	}
+	var sb strings.Builder
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || (p != path && filepath.Ext(p) != ".proto") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sb, "\n%s %d %d", p, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read proto descriptors: %v", err)
+	}
+	return "path:" + path, sb.String(), nil
+}
+
+func parseDescriptorSet(data []byte) (*protoregistry.Files, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid FileDescriptorSet: %v", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FileDescriptorSet (built with --include_imports?): %v", err)
+	}
+	return files, nil
+}
+
+// compileProtoDir compiles every .proto file below dir.
+func compileProtoDir(dir string) (*protoregistry.Files, error) {
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(p) == ".proto" {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proto directory: %v", err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no .proto files found in %s", dir)
+	}
+	sort.Strings(names)
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{ImportPaths: []string{dir}}),
+	}
+	compiled, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile .proto files: %v", err)
+	}
+	files := new(protoregistry.Files)
+	for _, f := range compiled {
+		if err := files.RegisterFile(f); err != nil {
+			return nil, fmt.Errorf("failed to register %s: %v", f.Path(), err)
+		}
+	}
+	return files, nil
+}
+
+// FindMessageByName and the other resolver methods look in the loaded
+// descriptors first and fall back to the well-known types, so Any values of
+// either kind can be expanded.
+func (r *protoRegistry) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if mt, err := r.types.FindMessageByName(name); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByName(name)
+}
+
+func (r *protoRegistry) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if mt, err := r.types.FindMessageByURL(url); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByURL(url)
+}
+
+func (r *protoRegistry) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	if xt, err := r.types.FindExtensionByName(field); err == nil {
+		return xt, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByName(field)
+}
+
+func (r *protoRegistry) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	if xt, err := r.types.FindExtensionByNumber(message, field); err == nil {
+		return xt, nil
+	}
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+// decodeMessage unmarshals value as the named message and renders it as
+// JSON with the proto field names, including unset fields so a change from
+// a default value shows up in the field diff.
+func (r *protoRegistry) decodeMessage(messageName string, value []byte) (json.RawMessage, error) {
+	mt, err := r.FindMessageByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("unknown message type %s", messageName)
+	}
+	msg := mt.New().Interface()
+	if err := (proto.UnmarshalOptions{Resolver: r}).Unmarshal(value, msg); err != nil {
+		return nil, fmt.Errorf("not a valid %s: %v", messageName, err)
+	}
+	out, err := protojson.MarshalOptions{Resolver: r, UseProtoNames: true, EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render %s: %v", messageName, err)
+	}
+	// protojson randomizes its whitespace; compact it for stable output.
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, out); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
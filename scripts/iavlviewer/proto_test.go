@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func resetProtoRegistries(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		protoRegistriesMu.Lock()
+		protoRegistries = map[string]*list.Element{}
+		protoRegistryLRU.Init()
+		protoRegistriesMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestProtoRegistryReplacedWhenDirectoryChanges(t *testing.T) {
+	resetProtoRegistries(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "counter.proto")
+	write := func(message string, mtime time.Time) {
+		t.Helper()
+		src := fmt.Sprintf("syntax = \"proto3\";\npackage test;\nmessage %s { uint64 n = 1; }\n", message)
+		if err := os.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("Counter", now.Add(-time.Hour))
+	first, err := loadProtoRegistry(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loadProtoRegistry(dir, nil); again != first {
+		t.Error("unchanged directory compiled again")
+	}
+
+	write("Gauge", now)
+	second, err := loadProtoRegistry(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("changed directory served from the cache")
+	}
+	if _, err := second.FindMessageByName(protoreflect.FullName("test.Gauge")); err != nil {
+		t.Errorf("new message missing: %v", err)
+	}
+	if n := protoRegistryLRU.Len(); n != 1 {
+		t.Errorf("%d registries cached for one directory, want 1", n)
+	}
+}
+
+func TestProtoRegistryCacheBounded(t *testing.T) {
+	resetProtoRegistries(t)
+	sets := make([][]byte, protoRegistryCacheEntries+1)
+	for i := range sets {
+		set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String(fmt.Sprintf("set%d.proto", i)),
+			Package: proto.String("test"),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sets[i] = set
+	}
+	first, err := loadProtoRegistry("", sets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range sets[1:] {
+		if _, err := loadProtoRegistry("", set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := protoRegistryLRU.Len(); n != protoRegistryCacheEntries {
+		t.Errorf("%d registries cached, want %d", n, protoRegistryCacheEntries)
+	}
+	if again, _ := loadProtoRegistry("", sets[0]); again == first {
+		t.Error("least recently used registry was not evicted")
+	}
+}
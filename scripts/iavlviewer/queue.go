@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// compressedTarExpansion is the assumed ratio between the extracted and the
+// compressed size of a tar.gz, tar.lz4 or tar.zst, whose extracted size isn't
+// known until it has been read to the end.
+const compressedTarExpansion = 4
+
+// estimateTimeout bounds estimateInputSize, which runs in the request handler
+// before the queue applies any limit. A source not sized in time counts as
+// zero, like one whose size can't be determined.
+var estimateTimeout = 5 * time.Second
+
+// insufficientDiskError is a comparison refused by admission control; the API
+// answers it with 507 Insufficient Storage.
+type insufficientDiskError struct {
+	Needed, Free, Reserve int64
+}
+
+func (e *insufficientDiskError) Error() string {
+	return fmt.Sprintf("the inputs need an estimated %d bytes, but only %d are free and %d must stay free", e.Needed, e.Free, e.Reserve)
+}
+
+// jobQueue runs at most workers comparisons at once and admits the others in
+// FIFO order. A job is only admitted when its estimated input size fits on
+// disk next to what the running jobs have reserved; otherwise it waits at the
+// head of the queue for them to finish, or is rejected when nothing is
+// running that could free up space.
+type jobQueue struct {
+	mu      sync.Mutex
+	workers int
+	// dir is where the free disk space is measured: the data dir in server
+	// mode.
+	dir string
+	// maxPerClient caps the jobs a client may have waiting; zero means no cap.
+	maxPerClient int
+	running      int
+	reserved     int64
+	waiting      []*queueTicket
+	// delayed is the ticket at the head that is waiting for disk space, so
+	// the delay is logged once.
+	delayed *queueTicket
+}
+
+var comparisonQueue = &jobQueue{workers: 2, maxPerClient: 10, dir: "."}
+
+// queueTicket is a comparison's place in the queue.
+type queueTicket struct {
+	q        *jobQueue
+	client   string
+	estimate int64
+	// admitted is closed when the job may start or has been rejected with err.
+	admitted chan struct{}
+	err      error
+	running  bool
+	// onPosition is told the ticket's position whenever it changes.
+	onPosition func(int)
+}
+
+// enqueue adds a job of client to the end of the queue.
+func (q *jobQueue) enqueue(client string, estimate int64) (*queueTicket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxPerClient > 0 {
+		queued := 0
+		for _, t := range q.waiting {
+			if t.client == client {
+				queued++
+			}
+		}
+		if queued >= q.maxPerClient {
+			return nil, fmt.Errorf("%s already has %d comparisons queued, the maximum", client, queued)
+		}
+	}
+	if err := q.checkDiskLocked(estimate, true); err != nil {
+		return nil, err
+	}
+	t := &queueTicket{q: q, client: client, estimate: estimate, admitted: make(chan struct{})}
+	q.waiting = append(q.waiting, t)
+	q.scheduleLocked()
+	return t, nil
+}
+
+// checkDiskLocked reports whether estimate more bytes fit on the disk holding
+// the inputs. With total set, the space reserved by running jobs is counted as
+// free, which tells a job that can never fit apart from one that has to wait.
+func (q *jobQueue) checkDiskLocked(estimate int64, total bool) error {
+	if estimate == 0 {
+		return nil
+	}
+	reserve := max(archiveLimits.minFreeDisk, 0)
+	free, ok := diskFree(q.dir)
+	if !ok {
+		return nil
+	}
+	if !total {
+		free -= q.reserved
+	}
+	if free-estimate < reserve {
+		return &insufficientDiskError{Needed: estimate, Free: free, Reserve: reserve}
+	}
+	return nil
+}
+
+// scheduleLocked admits jobs from the head of the queue while workers and
+// disk space are available, and tells the rest their new positions.
+func (q *jobQueue) scheduleLocked() {
+	for len(q.waiting) > 0 && q.running < q.workers {
+		t := q.waiting[0]
+		if err := q.checkDiskLocked(t.estimate, false); err != nil {
+			if q.running > 0 {
+				if q.delayed != t {
+					fmt.Printf("[Queue] Delaying a job of %s until running jobs free disk space: %v\n", t.client, err)
+					q.delayed = t
+				}
+				break
+			}
+			t.err = err
+		} else {
+			t.running = true
+			q.running++
+			q.reserved += t.estimate
+		}
+		q.waiting = q.waiting[1:]
+		close(t.admitted)
+	}
+	for i, t := range q.waiting {
+		if t.onPosition != nil {
+			t.onPosition(i + 1)
+		}
+	}
+}
+
+// positionLocked is t's 1-based place in the queue, or 0 once it has left.
+func (q *jobQueue) positionLocked(t *queueTicket) int {
+	for i, w := range q.waiting {
+		if w == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// watch calls f with the ticket's position now and whenever it changes while
+// the ticket waits.
+func (t *queueTicket) watch(f func(int)) {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	t.onPosition = f
+	if pos := t.q.positionLocked(t); pos > 0 {
+		f(pos)
+	}
+}
+
+// wait blocks until the job may run. It fails if the job was rejected for
+// lack of disk space or ctx ended first, which also takes it out of the queue.
+func (t *queueTicket) wait(ctx context.Context) error {
+	select {
+	case <-t.admitted:
+		return t.err
+	case <-ctx.Done():
+	}
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if pos := q.positionLocked(t); pos > 0 {
+		q.waiting = append(q.waiting[:pos-1], q.waiting[pos:]...)
+		q.scheduleLocked()
+	}
+	return ctx.Err()
+}
+
+// done frees the worker and the disk space reserved by an admitted job. It is
+// safe to call for tickets that never ran.
+func (t *queueTicket) done() {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !t.running {
+		return
+	}
+	t.running = false
+	q.running--
+	q.reserved -= t.estimate
+	q.scheduleLocked()
+}
+
+// requestClient identifies the client a request is queued for: its token, or
+// its address when authentication is disabled.
+func requestClient(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		return "token " + token.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// estimateInputSize estimates the disk space both sources of req take once
+// prepared. Sources that are opened in place or served from the cache take
+// none; sources whose size can't be determined count as zero and are left to
+// the extraction limits.
+func estimateInputSize(ctx context.Context, req CompareRequest) int64 {
+	ctx, cancel := context.WithTimeout(ctx, estimateTimeout)
+	defer cancel()
+	return estimateSourceSize(ctx, req.Source1) + estimateSourceSize(ctx, req.Source2)
+}
+
+func estimateSourceSize(ctx context.Context, req DataSourceRequest) int64 {
+	if req.Type == "upload" && req.UploadID != "" {
+		resolved, err := resolveUpload(req)
+		if err != nil {
+			return 0
+		}
+		req = resolved
+	}
+	if req.Type == "local" {
+		if req.Mode != "" && req.Mode != "copy" {
+			return 0
+		}
+		size, err := dirSize(ctx, req.Path)
+		if err != nil {
+			return 0
+		}
+		return size
+	}
+	if preparedCache != nil {
+		if key, err := sourceCacheKey(ctx, req); err == nil && key != "" && preparedCache.holds(key) {
+			return 0
+		}
+	}
+
+	switch req.Type {
+	case "upload":
+		return extractedSize(bytes.NewReader(req.Data), int64(len(req.Data)), req.Name)
+	case "archive_file", "zip_file":
+		f, err := os.Open(req.Path)
+		if err != nil {
+			return 0
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return 0
+		}
+		return extractedSize(f, info.Size(), req.Path)
+	case "archive_url", "zip_url":
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodHead, req.URL, nil)
+		if err != nil {
+			return 0
+		}
+		resp, err := sourceHTTPClient.Do(httpReq)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+			return 0
+		}
+		// The download is kept until extraction has finished.
+		return resp.ContentLength * (1 + compressedTarExpansion)
+	}
+	return 0
+}
+
+// extractedSize estimates what an archive of size bytes extracts to: exactly
+// for zip files, from their central directory, and by compressedTarExpansion
+// for compressed tar files.
+func extractedSize(r io.ReaderAt, size int64, name string) int64 {
+	head := make([]byte, sniffLen)
+	n, _ := r.ReadAt(head, 0)
+	format, err := sniffArchive(head[:n], name)
+	if err != nil {
+		return 0
+	}
+	switch format {
+	case formatZip:
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return 0
+		}
+		var total int64
+		for _, f := range zr.File {
+			total += int64(f.UncompressedSize64)
+		}
+		return total
+	case formatTar:
+		return size
+	}
+	return size * compressedTarExpansion
+}
+
+// queueErrorStatus is the HTTP status for a job the queue refused: the
+// client is over its queue cap, or the inputs don't fit on disk.
+func queueErrorStatus(err error) int {
+	if errorType(err) == ErrorTypeInsufficientDisk {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusTooManyRequests
+}
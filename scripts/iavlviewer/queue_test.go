@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEstimateInputSizeTimeout(t *testing.T) {
+	saved := estimateTimeout
+	estimateTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { estimateTimeout = saved })
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	req := CompareRequest{
+		Source1: DataSourceRequest{Type: "archive_url", URL: srv.URL + "/a.tar"},
+		Source2: DataSourceRequest{Type: "local", Path: t.TempDir()},
+	}
+	start := time.Now()
+	if size := estimateInputSize(context.Background(), req); size != 0 {
+		t.Errorf("size = %d, want 0", size)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("estimate took %s", elapsed)
+	}
+}
+
+func TestQueueMeasuresItsDir(t *testing.T) {
+	free, ok := diskFree(t.TempDir())
+	if !ok {
+		t.Skip("free disk space is unknown on this platform")
+	}
+	q := &jobQueue{workers: 1, dir: t.TempDir()}
+	_, err := q.enqueue("client", free+1<<40)
+	var diskErr *insufficientDiskError
+	if !errors.As(err, &diskErr) {
+		t.Fatalf("err = %v, want insufficient disk", err)
+	}
+	q.dir = "/nonexistent"
+	if _, err := q.enqueue("client", free+1<<40); err != nil {
+		t.Errorf("err = %v for a dir that can't be measured, want none", err)
+	}
+}
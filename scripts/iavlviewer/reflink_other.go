@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// reflink is only implemented on Linux; callers fall back to hardlinks and
+// copies.
+func reflink(src, dst string) error {
+	return errors.New("reflink is not supported on this platform")
+}
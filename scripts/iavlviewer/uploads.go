@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadStatus describes an uploaded archive. Sources refer to it with
+// {"type": "upload", "upload_id": ...} once it is complete.
+type UploadStatus struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	ID      string `json:"upload_id"`
+	Name    string `json:"name"`
+	// Size is the announced total size; Offset is how many bytes have been
+	// received so far. A resumed upload continues at Offset.
+	Size     int64  `json:"size"`
+	Offset   int64  `json:"offset"`
+	Complete bool   `json:"complete"`
+	SHA256   string `json:"sha256,omitempty"`
+	// ExpectedSHA256 is verified when the last chunk arrives.
+	ExpectedSHA256 string    `json:"expected_sha256,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// Owner is the client that created the upload; see requestOwner.
+	Owner string `json:"owner,omitempty"`
+}
+
+// upload is an archive below <uploads dir>/<id>/, stored under its original
+// file name next to upload.json. mu serializes chunks of the same upload.
+type upload struct {
+	mu     sync.Mutex
+	dir    string
+	status UploadStatus
+}
+
+var (
+	uploadsMu sync.Mutex
+	uploads   = map[string]*upload{}
+	uploadDir string
+	// uploadRetention is how long an upload is kept after its last chunk.
+	uploadRetention = 24 * time.Hour
+)
+
+// openUploads loads the uploads left in dir by a previous run, so resumable
+// uploads survive a restart.
+func openUploads(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create upload dir %s: %v", dir, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read upload dir %s: %v", dir, err)
+	}
+	uploadDir = dir
+	for _, f := range files {
+		u := &upload{dir: filepath.Join(dir, f.Name())}
+		data, err := os.ReadFile(filepath.Join(u.dir, "upload.json"))
+		if err == nil {
+			err = json.Unmarshal(data, &u.status)
+		}
+		if err != nil || u.status.ID != f.Name() {
+			os.RemoveAll(u.dir)
+			continue
+		}
+		uploads[u.status.ID] = u
+	}
+	return nil
+}
+
+func newUpload(name string, size int64, expectedSHA256, owner string) (*upload, error) {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = "archive"
+	}
+	now := time.Now().UTC()
+	u := &upload{status: UploadStatus{
+		ID:             generateTaskID(),
+		Name:           name,
+		Size:           size,
+		ExpectedSHA256: strings.ToLower(expectedSHA256),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		Owner:          owner,
+	}}
+	u.dir = filepath.Join(uploadDir, u.status.ID)
+	if err := os.MkdirAll(u.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := u.save(); err != nil {
+		os.RemoveAll(u.dir)
+		return nil, err
+	}
+	uploadsMu.Lock()
+	uploads[u.status.ID] = u
+	uploadsMu.Unlock()
+	return u, nil
+}
+
+func lookupUpload(id string) *upload {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	return uploads[id]
+}
+
+// lookupOwnedUpload returns the upload with the given ID if it belongs to
+// owner. Other clients' uploads are reported as missing.
+func lookupOwnedUpload(id, owner string) *upload {
+	if u := lookupUpload(id); u != nil && u.snapshot().Owner == owner {
+		return u
+	}
+	return nil
+}
+
+// checkUploadOwner rejects a comparison whose sources refer to an upload
+// that doesn't exist or belongs to another client.
+func checkUploadOwner(req CompareRequest) error {
+	for _, source := range []DataSourceRequest{req.Source1, req.Source2} {
+		if source.Type == "upload" && source.UploadID != "" && lookupOwnedUpload(source.UploadID, req.Owner) == nil {
+			return fmt.Errorf("unknown upload %s", source.UploadID)
+		}
+	}
+	return nil
+}
+
+func removeUpload(u *upload) {
+	uploadsMu.Lock()
+	delete(uploads, u.status.ID)
+	uploadsMu.Unlock()
+	os.RemoveAll(u.dir)
+}
+
+func (u *upload) path() string {
+	return filepath.Join(u.dir, u.status.Name)
+}
+
+func (u *upload) save() error {
+	data, err := json.Marshal(u.status)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(u.dir, "upload.json"), data, 0644)
+}
+
+func (u *upload) snapshot() UploadStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s := u.status
+	s.Success = true
+	return s
+}
+
+// complete records the checksum of the finished file and checks it against
+// the expected one. u.mu must be held.
+func (u *upload) complete(sum string) error {
+	if u.status.ExpectedSHA256 != "" && u.status.ExpectedSHA256 != sum {
+		return &checksumMismatchError{Expected: u.status.ExpectedSHA256, Actual: sum}
+	}
+	u.status.SHA256 = sum
+	u.status.Complete = true
+	return nil
+}
+
+// writeChunk writes body as bytes start..end of the upload; start must be the
+// current offset. A chunk cut short by a dropped connection keeps what
+// arrived, and the client resumes from the offset it gets back.
+func (u *upload) writeChunk(start, end int64, body io.Reader) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.status.Complete {
+		return errUploadComplete
+	}
+	if start != u.status.Offset {
+		return errUploadOffset
+	}
+	f, err := os.OpenFile(u.path(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(start); err != nil {
+		return err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	n, copyErr := io.Copy(&uploadWriter{w: f, name: u.status.Name, dir: u.dir, written: start}, io.LimitReader(body, end-start+1))
+	u.status.Offset += n
+	u.status.UpdatedAt = time.Now().UTC()
+	if u.status.Offset == u.status.Size {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		if err := u.complete(fmt.Sprintf("%x", h.Sum(nil))); err != nil {
+			return err
+		}
+	}
+	if err := u.save(); err != nil {
+		return err
+	}
+	return copyErr
+}
+
+var (
+	errUploadComplete = errors.New("upload is already complete")
+	errUploadOffset   = errors.New("chunk does not start at the current offset")
+)
+
+// uploadDiskCheckInterval is how many bytes an upload receives between
+// checks of the free disk space.
+const uploadDiskCheckInterval = 64 << 20
+
+// checkUploadSize rejects an upload announced larger than the extraction
+// limit, or than the disk can take while keeping minFreeDisk free.
+func checkUploadSize(name string, size int64) error {
+	if max := archiveLimits.maxBytes; max > 0 && size > max {
+		return limitf("%s is %d bytes, over the limit of %d", name, size, max)
+	}
+	if reserve := archiveLimits.minFreeDisk; reserve > 0 {
+		if free, ok := diskFree(uploadDir); ok && free-size < reserve {
+			return limitf("%s needs %d bytes, but only %d are free and %d must stay free", name, size, free, reserve)
+		}
+	}
+	return nil
+}
+
+// uploadWriter writes an upload to disk and stops once it outgrows the
+// extraction limit or the disk fills up to minFreeDisk.
+type uploadWriter struct {
+	w       io.Writer
+	name    string
+	dir     string
+	written int64
+	// nextCheck is the size at which the free space is checked next.
+	nextCheck int64
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	size := w.written + int64(len(p))
+	if max := archiveLimits.maxBytes; max > 0 && size > max {
+		return 0, limitf("%s is larger than the limit of %d bytes", w.name, max)
+	}
+	if reserve := archiveLimits.minFreeDisk; reserve > 0 && size >= w.nextCheck {
+		if free, ok := diskFree(w.dir); ok && free-int64(len(p)) < reserve {
+			return 0, limitf("receiving %s would leave less than %d bytes free", w.name, reserve)
+		}
+		w.nextCheck = size + uploadDiskCheckInterval
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// resolveUpload turns a source that refers to an upload by ID into an
+// archive_file source for the uploaded file.
+func resolveUpload(req DataSourceRequest) (DataSourceRequest, error) {
+	u := lookupUpload(req.UploadID)
+	if u == nil {
+		return req, fmt.Errorf("unknown upload %s", req.UploadID)
+	}
+	status := u.snapshot()
+	if !status.Complete {
+		return req, fmt.Errorf("upload %s is incomplete (%d of %d bytes)", status.ID, status.Offset, status.Size)
+	}
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, status.SHA256) {
+		return req, &checksumMismatchError{Expected: strings.ToLower(req.SHA256), Actual: status.SHA256}
+	}
+	req.Type = "archive_file"
+	req.Path = u.path()
+	req.SHA256 = status.SHA256
+	return req, nil
+}
+
+// pruneUploads removes uploads that have seen no data for uploadRetention.
+func pruneUploads(interval time.Duration) {
+	for range time.Tick(interval) {
+		uploadsMu.Lock()
+		all := make([]*upload, 0, len(uploads))
+		for _, u := range uploads {
+			all = append(all, u)
+		}
+		uploadsMu.Unlock()
+		for _, u := range all {
+			if status := u.snapshot(); time.Since(status.UpdatedAt) > uploadRetention {
+				removeUpload(u)
+				fmt.Printf("[INFO] Removed expired upload %s\n", status.ID)
+			}
+		}
+	}
+}
+
+// handleUploadsAPI creates an upload. A multipart/form-data body streams its
+// "file" part, and an optional "sha256" field, to disk in one go; a JSON body
+// {"name", "size", "sha256"} opens a resumable upload whose chunks are sent
+// with PUT /uploads/{id}. Uploads larger than --max-extract-size, or that
+// would leave less than --min-free-disk free, are refused with 413.
+func handleUploadsAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[Uploads] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(UploadStatus{Success: false, Error: msg})
+	}
+
+	if r.Method != http.MethodPost {
+		fail(http.StatusMethodNotAllowed, "Method not allowed. Use POST.")
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		status, code, err := receiveMultipartUpload(r, requestOwner(r))
+		if err != nil {
+			fail(code, err.Error())
+			return
+		}
+		fmt.Printf("[Uploads] Received %s (%d bytes) as upload %s\n", status.Name, status.Size, status.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	var req struct {
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fail(http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	if req.Size <= 0 {
+		fail(http.StatusBadRequest, "size must be a positive number of bytes")
+		return
+	}
+	if err := checkUploadSize(req.Name, req.Size); err != nil {
+		fail(http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	u, err := newUpload(req.Name, req.Size, req.SHA256, requestOwner(r))
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Sprintf("Failed to create upload: %v", err))
+		return
+	}
+	fmt.Printf("[Uploads] Started resumable upload %s for %s (%d bytes)\n", u.status.ID, u.status.Name, u.status.Size)
+	w.Header().Set("Location", "/uploads/"+u.status.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u.snapshot())
+}
+
+// receiveMultipartUpload streams the "file" part of a multipart request to a
+// new upload, hashing it on the way. An optional "sha256" field sent before
+// the file is verified.
+func receiveMultipartUpload(r *http.Request, owner string) (UploadStatus, int, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return UploadStatus{}, http.StatusBadRequest, fmt.Errorf("invalid multipart body: %v", err)
+	}
+	var expected string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return UploadStatus{}, http.StatusBadRequest, errors.New("missing file part")
+		}
+		if err != nil {
+			return UploadStatus{}, http.StatusBadRequest, fmt.Errorf("invalid multipart body: %v", err)
+		}
+		switch part.FormName() {
+		case "sha256":
+			value, _ := io.ReadAll(io.LimitReader(part, 128))
+			expected = strings.TrimSpace(string(value))
+			continue
+		case "file":
+		default:
+			continue
+		}
+
+		u, err := newUpload(part.FileName(), 0, expected, owner)
+		if err != nil {
+			return UploadStatus{}, http.StatusInternalServerError, fmt.Errorf("failed to create upload: %v", err)
+		}
+		f, err := os.Create(u.path())
+		if err != nil {
+			removeUpload(u)
+			return UploadStatus{}, http.StatusInternalServerError, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(&uploadWriter{w: f, name: u.status.Name, dir: u.dir}, h), part)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		var limitErr *archiveLimitError
+		if errors.As(err, &limitErr) {
+			removeUpload(u)
+			return UploadStatus{}, http.StatusRequestEntityTooLarge, err
+		}
+		if err != nil {
+			removeUpload(u)
+			return UploadStatus{}, http.StatusBadRequest, fmt.Errorf("failed to receive file: %v", err)
+		}
+
+		u.mu.Lock()
+		u.status.Size, u.status.Offset = n, n
+		err = u.complete(fmt.Sprintf("%x", h.Sum(nil)))
+		if err == nil {
+			err = u.save()
+		}
+		u.mu.Unlock()
+		if err != nil {
+			removeUpload(u)
+			return UploadStatus{}, http.StatusUnprocessableEntity, err
+		}
+		return u.snapshot(), http.StatusCreated, nil
+	}
+}
+
+// handleUploadAPI serves a single upload: GET reports its status and offset,
+// PUT appends a chunk described by a "Content-Range: bytes start-end/total"
+// header, and DELETE discards it.
+func handleUploadAPI(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fmt.Printf("[Uploads] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	id := r.PathValue("id")
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(UploadStatus{Success: false, ID: id, Error: msg})
+	}
+
+	u := lookupOwnedUpload(id, requestOwner(r))
+	if u == nil {
+		fail(http.StatusNotFound, fmt.Sprintf("Upload %s not found", id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(u.snapshot())
+
+	case http.MethodPut:
+		start, end, err := parseContentRange(r.Header.Get("Content-Range"), u.snapshot().Size)
+		if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		err = u.writeChunk(start, end, r.Body)
+		status := u.snapshot()
+		var mismatch *checksumMismatchError
+		var limitErr *archiveLimitError
+		switch {
+		case errors.Is(err, errUploadOffset), errors.Is(err, errUploadComplete):
+			// Tell the client where to resume.
+			status.Success = false
+			status.Error = err.Error()
+			w.WriteHeader(http.StatusConflict)
+		case errors.As(err, &limitErr):
+			status.Success = false
+			status.Error = err.Error()
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case errors.As(err, &mismatch):
+			removeUpload(u)
+			status.Success = false
+			status.Error = err.Error()
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case err != nil:
+			status.Success = false
+			status.Error = fmt.Sprintf("Failed to write chunk: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodDelete:
+		status := u.snapshot()
+		removeUpload(u)
+		fmt.Printf("[Uploads] Deleted upload %s\n", id)
+		json.NewEncoder(w).Encode(status)
+
+	default:
+		fail(http.StatusMethodNotAllowed, "Method not allowed. Use GET, PUT or DELETE.")
+	}
+}
+
+// parseContentRange returns the inclusive byte range of a
+// "bytes start-end/total" header, checking it against the upload's size.
+func parseContentRange(header string, size int64) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, errors.New(`missing or invalid Content-Range header, expected "bytes start-end/total"`)
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	first, last, ok2 := strings.Cut(rng, "-")
+	if !ok || !ok2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if total != "*" && total != strconv.FormatInt(size, 10) {
+		return 0, 0, fmt.Errorf("total %s in Content-Range does not match the upload size of %d bytes", total, size)
+	}
+	if end >= size {
+		return 0, 0, fmt.Errorf("range %d-%d ends beyond the upload size of %d bytes", start, end, size)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withUploadDir(t *testing.T) {
+	t.Helper()
+	saved := uploadDir
+	uploadDir = t.TempDir()
+	t.Cleanup(func() {
+		uploadsMu.Lock()
+		for id, u := range uploads {
+			if strings.HasPrefix(u.dir, uploadDir) {
+				delete(uploads, id)
+			}
+		}
+		uploadsMu.Unlock()
+		uploadDir = saved
+	})
+}
+
+func multipartUpload(t *testing.T, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "snap.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/uploads", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadLimits(t *testing.T) {
+	withUploadDir(t)
+	withArchiveLimits(t, extractLimits{maxBytes: 1000})
+	uploadCount := func() int {
+		uploadsMu.Lock()
+		defer uploadsMu.Unlock()
+		return len(uploads)
+	}
+	before := uploadCount()
+
+	w := httptest.NewRecorder()
+	handleUploadsAPI(w, multipartUpload(t, make([]byte, 1001)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized multipart upload: code = %d, want 413: %s", w.Code, w.Body)
+	}
+	if n := uploadCount(); n != before {
+		t.Errorf("oversized multipart upload was kept")
+	}
+
+	w = httptest.NewRecorder()
+	handleUploadsAPI(w, httptest.NewRequest(http.MethodPost, "/uploads", strings.NewReader(`{"name":"snap.tar","size":1001}`)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized resumable upload: code = %d, want 413: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleUploadsAPI(w, multipartUpload(t, make([]byte, 1000)))
+	if w.Code != http.StatusCreated {
+		t.Errorf("upload at the limit: code = %d, want 201: %s", w.Code, w.Body)
+	}
+
+	// The reserve is checked while the file streams in.
+	withArchiveLimits(t, extractLimits{minFreeDisk: 1 << 62})
+	w = httptest.NewRecorder()
+	handleUploadsAPI(w, multipartUpload(t, []byte("x")))
+	if _, ok := diskFree(uploadDir); ok && w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload past the disk reserve: code = %d, want 413: %s", w.Code, w.Body)
+	}
+}
@@ -26,8 +26,8 @@ export default function DebugConsensusPage() {
 
   // Helper to auto-detect type
   function detectSourceType(val: string) {
-    if (/^https?:\/\//i.test(val)) return "zip_url";
-    if (/\.zip$/i.test(val)) return "zip_file";
+    if (/^https?:\/\//i.test(val)) return "archive_url";
+    if (/\.(zip|tar|tar\.gz|tgz|tar\.lz4|tar\.zst)$/i.test(val)) return "archive_file";
     return "local";
   }
 